@@ -0,0 +1,418 @@
+package asm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"monkey-c/code"
+	"monkey-c/compiler"
+	"monkey-c/disasm"
+	"monkey-i/object"
+	"strconv"
+	"strings"
+)
+
+/*
+reads the listing format printed by the disassembler back into bytecode,
+so disassembling and reassembling a program gives the same bytes back.
+hand written sources may leave out what the listing spells out:
+
+	.const int 5                     ; index defaults to the next free one
+	.func "add" params=2 locals=2    ; as does a function's, counts to 0
+	.locals "a" "b"                  ; optional, names of the local slots
+	.pos "add.mk" 3 5                ; optional, where the code below comes from
+	    OpGetLocal 0
+	loop:                            ; any name works as a label
+	    OpJump loop
+
+instructions before the first .func belong to main, a leading offset
+column is ignored and ';' starts a comment. operands too large for an
+instruction give its OpWide form, which can also be asked for directly
+*/
+func Assemble(src string) (*compiler.Bytecode, error) {
+	a := &assembler{constants: map[int]object.Object{}}
+	a.main = newSection("main", nil)
+	a.current = a.main
+
+	for i, line := range strings.Split(src, "\n") {
+		a.line = i + 1
+		if err := a.parseLine(line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", a.line, err)
+		}
+	}
+
+	if err := a.finishSection(); err != nil {
+		return nil, err
+	}
+	return a.bytecode()
+}
+
+type fixup struct {
+	offset int // operand position inside the section's instructions
+	width  int
+	label  string
+	line   int
+}
+
+type section struct {
+	name         string
+	fn           *code.CompiledFunction // nil for main
+	instructions code.Instructions
+	positions    code.PositionTable
+	labels       map[string]int
+	fixups       []fixup
+}
+
+// empty tables rather than nil ones, the way the compiler leaves them
+func newSection(name string, fn *code.CompiledFunction) *section {
+	return &section{name: name, fn: fn, positions: code.PositionTable{}, labels: map[string]int{}}
+}
+
+type assembler struct {
+	line      int
+	main      *section
+	current   *section
+	sawMain   bool
+	constants map[int]object.Object
+	next      int
+}
+
+func (a *assembler) parseLine(line string) error {
+	fields, err := splitFields(stripComment(line))
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+
+	switch {
+	case fields[0] == ".const":
+		return a.parseConst(fields[1:])
+	case fields[0] == ".func":
+		return a.parseFunc(fields[1:])
+	case fields[0] == ".pos":
+		return a.parsePos(fields[1:])
+	case fields[0] == ".locals":
+		return a.parseLocals(fields[1:])
+	case strings.HasSuffix(fields[0], ":") && len(fields) == 1:
+		return a.defineLabel(strings.TrimSuffix(fields[0], ":"))
+	}
+
+	if isNumber(fields[0]) {
+		fields = fields[1:] // offset column of a listing
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("offset without an instruction")
+	}
+	return a.parseInstruction(fields[0], fields[1:])
+}
+
+func (a *assembler) defineLabel(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty label")
+	}
+	if _, ok := a.current.labels[name]; ok {
+		return fmt.Errorf("label %s already defined in %s", name, a.current.name)
+	}
+	a.current.labels[name] = len(a.current.instructions)
+	return nil
+}
+
+func (a *assembler) parseInstruction(mnemonic string, args []string) error {
+	wide := mnemonic == "OpWide"
+	if wide {
+		if len(args) == 0 {
+			return fmt.Errorf("OpWide without an instruction")
+		}
+		mnemonic, args = args[0], args[1:]
+	}
+
+	op, def, ok := code.LookupName(mnemonic)
+	if !ok {
+		return fmt.Errorf("unknown mnemonic %s", mnemonic)
+	}
+	if len(args) != len(def.OperandWidths) {
+		return fmt.Errorf("%s takes %d operands, got %d", mnemonic, len(def.OperandWidths), len(args))
+	}
+
+	offset := len(a.current.instructions)
+	operands := make([]int, len(args))
+	var label *fixup
+	for i, arg := range args {
+		if i == 0 && disasm.IsJump(op) && !isNumber(arg) {
+			// resolved once the whole section is read, labels may come later
+			label = &fixup{label: arg, line: a.line}
+			continue
+		}
+
+		value, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("%s operand %d: %q is not a number", mnemonic, i, arg)
+		}
+		operands[i] = value
+	}
+
+	// operands too large for the normal layout get the wide one without asking
+	ins, err := code.Make(op, operands...)
+	if wide || err != nil {
+		ins, err = code.MakeWide(op, operands...)
+	}
+	if err != nil {
+		return err
+	}
+
+	if label != nil {
+		label.offset, label.width = offset+1, 2
+		if wide {
+			label.offset, label.width = offset+2, 4
+		}
+		a.current.fixups = append(a.current.fixups, *label)
+	}
+	a.current.instructions = append(a.current.instructions, ins...)
+	return nil
+}
+
+// `.const [index] int|string|float literal`
+func (a *assembler) parseConst(args []string) error {
+	index, args, err := a.constIndex(args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return fmt.Errorf(".const wants a type and a literal")
+	}
+
+	var constant object.Object
+	switch args[0] {
+	case "int":
+		v, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad int %s", args[1])
+		}
+		constant = &object.Integer{Value: v}
+	case "float":
+		v, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return fmt.Errorf("bad float %s", args[1])
+		}
+		constant = &code.Float{Value: v}
+	case "string":
+		v, err := strconv.Unquote(args[1])
+		if err != nil {
+			return fmt.Errorf("bad string %s", args[1])
+		}
+		constant = &object.String{Value: v}
+	default:
+		return fmt.Errorf("unknown constant type %s", args[0])
+	}
+
+	return a.defineConstant(index, constant)
+}
+
+// `.func main` or `.func [index] ["name"] [params=N] [locals=N]`
+func (a *assembler) parseFunc(args []string) error {
+	if err := a.finishSection(); err != nil {
+		return err
+	}
+
+	if len(args) == 1 && args[0] == "main" {
+		if a.sawMain || len(a.main.instructions) > 0 {
+			return fmt.Errorf("main defined twice")
+		}
+		a.sawMain = true
+		a.current = a.main
+		return nil
+	}
+
+	index, args, err := a.constIndex(args)
+	if err != nil {
+		return err
+	}
+
+	fn := &code.CompiledFunction{LocalNames: []string{}}
+	if len(args) > 0 && strings.HasPrefix(args[0], `"`) {
+		if fn.Name, err = strconv.Unquote(args[0]); err != nil {
+			return fmt.Errorf("bad function name %s", args[0])
+		}
+		args = args[1:]
+	}
+
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil || n < 0 {
+			return fmt.Errorf("bad function attribute %s", arg)
+		}
+
+		switch key {
+		case "params":
+			fn.NumParameters = n
+		case "locals":
+			fn.NumLocals = n
+		default:
+			return fmt.Errorf("unknown function attribute %s", key)
+		}
+	}
+
+	if err := a.defineConstant(index, fn); err != nil {
+		return err
+	}
+	a.current = newSection(fmt.Sprintf("constant %d", index), fn)
+	return nil
+}
+
+// `.pos "file" line column` -> the instructions from here on come from there
+func (a *assembler) parsePos(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf(".pos wants a file, a line and a column")
+	}
+	file, err := strconv.Unquote(args[0])
+	if err != nil {
+		return fmt.Errorf("bad file name %s", args[0])
+	}
+	line, lineErr := strconv.Atoi(args[1])
+	column, columnErr := strconv.Atoi(args[2])
+	if lineErr != nil || columnErr != nil || line < 0 || column < 0 {
+		return fmt.Errorf("bad position %s %s", args[1], args[2])
+	}
+
+	a.current.positions = append(a.current.positions, code.PositionEntry{
+		Offset: len(a.current.instructions),
+		Pos:    code.Position{File: file, Line: line, Column: column},
+	})
+	return nil
+}
+
+// `.locals "name"...` names the local slots of the current function in order
+func (a *assembler) parseLocals(args []string) error {
+	if a.current.fn == nil {
+		return fmt.Errorf(".locals outside of a function")
+	}
+	for _, arg := range args {
+		name, err := strconv.Unquote(arg)
+		if err != nil {
+			return fmt.Errorf("bad local name %s", arg)
+		}
+		a.current.fn.LocalNames = append(a.current.fn.LocalNames, name)
+	}
+	return nil
+}
+
+func (a *assembler) constIndex(args []string) (int, []string, error) {
+	if len(args) == 0 || !isNumber(args[0]) {
+		return a.next, args, nil
+	}
+	index, err := strconv.Atoi(args[0])
+	if err != nil || index >= 1<<16 {
+		return 0, nil, fmt.Errorf("constant index %s out of range", args[0])
+	}
+	return index, args[1:], nil
+}
+
+func (a *assembler) defineConstant(index int, constant object.Object) error {
+	if _, ok := a.constants[index]; ok {
+		return fmt.Errorf("constant %d already defined", index)
+	}
+	a.constants[index] = constant
+	if index >= a.next {
+		a.next = index + 1
+	}
+	return nil
+}
+
+func (a *assembler) finishSection() error {
+	s := a.current
+	for _, f := range s.fixups {
+		target, ok := s.labels[f.label]
+		if !ok {
+			return fmt.Errorf("line %d: undefined label %s in %s", f.line, f.label, s.name)
+		}
+		if !code.Fits(target, f.width) {
+			return fmt.Errorf("line %d: label %s out of jump range, use OpWide", f.line, f.label)
+		}
+		if f.width == 4 {
+			binary.BigEndian.PutUint32(s.instructions[f.offset:], uint32(target))
+		} else {
+			binary.BigEndian.PutUint16(s.instructions[f.offset:], uint16(target))
+		}
+	}
+	s.fixups = nil
+
+	if s.fn != nil {
+		s.fn.Instructions = s.instructions
+		s.fn.Positions = s.positions
+	}
+	return nil
+}
+
+func (a *assembler) bytecode() (*compiler.Bytecode, error) {
+	constants := make([]object.Object, a.next)
+	for i := range constants {
+		constant, ok := a.constants[i]
+		if !ok {
+			return nil, fmt.Errorf("constant %d is never defined", i)
+		}
+		constants[i] = constant
+	}
+
+	instructions := a.main.instructions
+	if instructions == nil {
+		instructions = code.Instructions{}
+	}
+	return &compiler.Bytecode{Instructions: instructions, Constants: constants, Positions: a.main.positions}, nil
+}
+
+// ';' outside a string literal starts a comment
+func stripComment(line string) string {
+	inString, escaped := false, false
+	for i, ch := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && ch == '\\':
+			escaped = true
+		case ch == '"':
+			inString = !inString
+		case ch == ';' && !inString:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// whitespace separated, a quoted string stays one field
+func splitFields(line string) ([]string, error) {
+	fields := []string{}
+	for {
+		line = strings.TrimLeft(line, " \t\r")
+		if line == "" {
+			return fields, nil
+		}
+
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t\r")
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("unterminated string %s", line)
+		}
+		fields = append(fields, quoted)
+		line = line[len(quoted):]
+	}
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
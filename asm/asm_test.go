@@ -0,0 +1,249 @@
+package asm
+
+import (
+	"bytes"
+	"monkey-c/code"
+	"monkey-c/compiler"
+	"monkey-c/disasm"
+	"monkey-i/lexer"
+	"monkey-i/object"
+	"monkey-i/parser"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	inputs := []string{
+		"",
+		"1 + 2; 3.0;",
+		`let x = if (true) { 10 } else { 20 }; let greet = fn(name) { "hi; there " + name }; greet("bob");`,
+		"let f = fn(n) { if (n > 1) { n * f(n - 1) } else { 1 } }; f(5);",
+		"let add = fn(a) { fn(b) { a + b } }; let m = {1: [1, 2], \"k\": add(1)(2)}; m[1][0];",
+		"if (true && false || true) { puts(len([1])) };",
+	}
+
+	for _, input := range inputs {
+		p := parser.New(lexer.New(input))
+		comp := compiler.New()
+		comp.SetSource("roundtrip.mk", input)
+		if err := comp.Compile(p.ParseProgram()); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		original := comp.Bytecode()
+
+		listing, err := disasm.Disassemble(original)
+		if err != nil {
+			t.Fatalf("%q: disassemble error: %s", input, err)
+		}
+
+		assembled, err := Assemble(listing)
+		if err != nil {
+			t.Fatalf("%q: assemble error: %s\n%s", input, err, listing)
+		}
+
+		want, _ := original.MarshalBinary()
+		got, err := assembled.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%q: encode error: %s", input, err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("%q: reassembled bytecode differs.\nlisting:\n%s", input, listing)
+		}
+		if !reflect.DeepEqual(original, assembled) {
+			t.Errorf("%q: reassembled bytecode differs.\nwant=%#v\ngot=%#v", input, original, assembled)
+		}
+
+		relisted, _ := disasm.Disassemble(assembled)
+		if relisted != listing {
+			t.Errorf("%q: listing changed.\nwant=\n%s\ngot=\n%s", input, listing, relisted)
+		}
+	}
+}
+
+func TestAssembleHandWritten(t *testing.T) {
+	src := `
+; count down from 3, leaving the last value
+.const int 3
+.const int 1
+
+    OpConstant 0
+    OpSetGlobal 0
+loop:
+    OpGetGlobal 0
+    OpConstant 1            ; 1
+    OpGreaterThan
+    OpJumpNotTruthy done
+    OpGetGlobal 0
+    OpConstant 1
+    OpSub
+    OpSetGlobal 0
+    OpJump loop
+done:
+    OpClosure 2 0
+    OpCall 0
+    OpPop
+
+.func "answer" locals=1
+    OpConstant 3
+    OpReturnValue
+.const float 4.5
+`
+
+	b, err := Assemble(src)
+	if err != nil {
+		t.Fatalf("assemble error: %s", err)
+	}
+
+	expected := bytes.Join([][]byte{
+		code.MustMake(code.OpConstant, 0),
+		code.MustMake(code.OpSetGlobal, 0),
+		code.MustMake(code.OpGetGlobal, 0),
+		code.MustMake(code.OpConstant, 1),
+		code.MustMake(code.OpGreaterThan),
+		code.MustMake(code.OpJumpNotTruthy, 29),
+		code.MustMake(code.OpGetGlobal, 0),
+		code.MustMake(code.OpConstant, 1),
+		code.MustMake(code.OpSub),
+		code.MustMake(code.OpSetGlobal, 0),
+		code.MustMake(code.OpJump, 6),
+		code.MustMake(code.OpClosure, 2, 0),
+		code.MustMake(code.OpCall, 0),
+		code.MustMake(code.OpPop),
+	}, nil)
+	if !bytes.Equal(b.Instructions, expected) {
+		t.Errorf("wrong instructions.\nwant=%s\ngot=%s", code.Instructions(expected), b.Instructions)
+	}
+
+	if len(b.Constants) != 4 {
+		t.Fatalf("wrong number of constants. want=4, got=%d", len(b.Constants))
+	}
+	fn, ok := b.Constants[2].(*code.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 2 is not a function. got=%T", b.Constants[2])
+	}
+	if fn.Name != "answer" || fn.NumLocals != 1 || fn.NumParameters != 0 {
+		t.Errorf("wrong function header. got=%+v", fn)
+	}
+	if f, ok := b.Constants[3].(*code.Float); !ok || f.Value != 4.5 {
+		t.Errorf("wrong constant 3. got=%v", b.Constants[3])
+	}
+	if s, ok := b.Constants[0].(*object.Integer); !ok || s.Value != 3 {
+		t.Errorf("wrong constant 0. got=%v", b.Constants[0])
+	}
+}
+
+func TestAssembleDebugInfo(t *testing.T) {
+	b, err := Assemble(`
+.pos "m.mk" 1 1
+    OpClosure 0 0
+.pos "m.mk" 2 1
+    OpPop
+.func "f" params=1 locals=2
+.locals "n" "total"
+.pos "m.mk" 1 12
+    OpGetLocal 1
+    OpReturnValue
+`)
+	if err != nil {
+		t.Fatalf("assemble error: %s", err)
+	}
+
+	mainPositions := code.PositionTable{{Offset: 0, Pos: code.Position{File: "m.mk", Line: 1, Column: 1}}, {Offset: 4, Pos: code.Position{File: "m.mk", Line: 2, Column: 1}}}
+	if !reflect.DeepEqual(b.Positions, mainPositions) {
+		t.Errorf("wrong main positions. got=%v", b.Positions)
+	}
+	fn := b.Constants[0].(*code.CompiledFunction)
+	if !reflect.DeepEqual(fn.LocalNames, []string{"n", "total"}) {
+		t.Errorf("wrong local names. got=%q", fn.LocalNames)
+	}
+	if pos, _ := fn.Positions.Lookup(2); pos != (code.Position{File: "m.mk", Line: 1, Column: 12}) {
+		t.Errorf("wrong function position. got=%s", pos)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{"OpFrobnicate", "line 1: unknown mnemonic OpFrobnicate"},
+		{"OpConstant", "line 1: OpConstant takes 1 operands, got 0"},
+		{"OpGetLocal 70000", "line 1: operand 0 of OpGetLocal: 70000 does not fit in 2 bytes"},
+		{"OpWide OpPop", "line 1: opcode 5 has no wide form"},
+		{"OpConstant x", `line 1: OpConstant operand 0: "x" is not a number`},
+		{"OpJump nowhere", "line 1: undefined label nowhere in main"},
+		{"a:\na:", "line 2: label a already defined in main"},
+		{".const 0 int 1\n.const 0 int 2", "line 2: constant 0 already defined"},
+		{".const 1 int 1", "constant 0 is never defined"},
+		{".const bool true", "line 1: unknown constant type bool"},
+		{`.const string "open`, "line 1: unterminated string"},
+		{".func main\n.func main", "line 2: main defined twice"},
+		{`.func "f" arity=2`, "line 1: unknown function attribute arity"},
+		{`.locals "a"`, "line 1: .locals outside of a function"},
+		{`.pos "a.mk" 1`, "line 1: .pos wants a file, a line and a column"},
+		{`.pos "a.mk" one 1`, "line 1: bad position one 1"},
+	}
+
+	for _, tt := range tests {
+		_, err := Assemble(tt.src)
+		if err == nil {
+			t.Errorf("%q: expected error but resulted in none.", tt.src)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.expected) {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.src, tt.expected, err)
+		}
+	}
+}
+
+func TestAssembleWide(t *testing.T) {
+	b, err := Assemble(`
+    OpGetLocal 300          ; widened on its own
+    OpWide OpConstant 1
+    OpWide OpJump end
+end:
+`)
+	if err != nil {
+		t.Fatalf("assemble error: %s", err)
+	}
+
+	expected := bytes.Join([][]byte{
+		mustMakeWide(code.OpGetLocal, 300),
+		mustMakeWide(code.OpConstant, 1),
+		mustMakeWide(code.OpJump, 16),
+	}, nil)
+	if !bytes.Equal(b.Instructions, expected) {
+		t.Errorf("wrong instructions.\nwant=%s\ngot=%s", code.Instructions(expected), b.Instructions)
+	}
+
+	listing, err := disasm.Disassemble(b)
+	if err != nil {
+		t.Fatalf("disassemble error: %s", err)
+	}
+	again, err := Assemble(listing)
+	if err != nil {
+		t.Fatalf("reassemble error: %s\n%s", err, listing)
+	}
+	if !bytes.Equal(again.Instructions, expected) {
+		t.Errorf("listing does not reassemble.\n%s", listing)
+	}
+}
+
+func mustMakeWide(op code.Opcode, operands ...int) []byte {
+	ins, err := code.MakeWide(op, operands...)
+	if err != nil {
+		panic(err)
+	}
+	return ins
+}
+
+func TestAssembleQuotedStrings(t *testing.T) {
+	b, err := Assemble(`.const string "a;\"b\"\n" ; trailing comment`)
+	if err != nil {
+		t.Fatalf("assemble error: %s", err)
+	}
+	if s, ok := b.Constants[0].(*object.String); !ok || s.Value != "a;\"b\"\n" {
+		t.Errorf("wrong constant 0. got=%v", b.Constants[0])
+	}
+}
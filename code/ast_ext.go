@@ -34,3 +34,74 @@ func (nfl *NamedFunctionBlock) String() string {
 
 	return out.String()
 }
+
+/*
+ast.Statement is sealed by an unexported marker method, so statement
+extensions embed ast.ExpressionStatement to pick it up (same trick as
+NamedFunctionBlock riding on ast.FunctionBlock). Token holds the keyword.
+the monkey-i parser knows no while, break or continue -> these nodes only
+come from ASTs built in Go
+*/
+type WhileStatement struct {
+	ast.ExpressionStatement
+	Condition ast.Expression
+	Body      *ast.BlockStatement
+}
+
+func (ws *WhileStatement) statementNode()       {}
+func (ws *WhileStatement) TokenLiteral() string { return ws.Token.Literal }
+func (ws *WhileStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("while")
+	out.WriteString(ws.Condition.String())
+	out.WriteString(" ")
+	out.WriteString(ws.Body.String())
+
+	return out.String()
+}
+
+type BreakStatement struct {
+	ast.ExpressionStatement
+}
+
+func (bs *BreakStatement) statementNode()       {}
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) String() string       { return bs.TokenLiteral() + ";" }
+
+type ContinueStatement struct {
+	ast.ExpressionStatement
+}
+
+func (cs *ContinueStatement) statementNode()       {}
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) String() string       { return cs.TokenLiteral() + ";" }
+
+/*
+Left is the assignment target (identifier or index expression) and
+Operator is one of "=", "+=", "-=", "*=", "/=". the parser has no
+assignment operators, only ASTs built in Go contain this node
+*/
+type AssignExpression struct {
+	ast.InfixExpression
+}
+
+func (ae *AssignExpression) expressionNode()      {}
+func (ae *AssignExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AssignExpression) String() string {
+	return ae.Left.String() + " " + ae.Operator + " " + ae.Right.String()
+}
+
+/*
+expressions are sealed the same way -> FloatLiteral embeds ast.IntegerLiteral
+for the marker and the number token, its own Value shadows the integer one.
+the monkey-i lexer stops a number at the dot, so only Go code builds these
+*/
+type FloatLiteral struct {
+	ast.IntegerLiteral
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode()      {}
+func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
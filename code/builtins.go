@@ -0,0 +1,150 @@
+package code
+
+import (
+	"fmt"
+	"io"
+	"monkey-i/object"
+	"os"
+)
+
+/*
+builtins are resolved by position, so the order here is
+part of the bytecode contract -> only ever append to it
+*/
+var Builtins = []struct {
+	Name    string
+	Builtin *object.Builtin
+}{
+	{"len", &object.Builtin{Fn: builtinLen}},
+	{"puts", &object.Builtin{Fn: builtinPuts}},
+	{"first", &object.Builtin{Fn: builtinFirst}},
+	{"last", &object.Builtin{Fn: builtinLast}},
+	{"rest", &object.Builtin{Fn: builtinRest}},
+	{"push", &object.Builtin{Fn: builtinPush}},
+}
+
+/*
+the same table with puts writing to w -> a VM hands these out instead of
+the shared ones, so a program's output goes wherever its host points it
+*/
+func BuiltinsWritingTo(w io.Writer) []*object.Builtin {
+	builtins := make([]*object.Builtin, len(Builtins))
+	for i, def := range Builtins {
+		builtins[i] = def.Builtin
+		if def.Name == "puts" {
+			builtins[i] = &object.Builtin{Fn: func(args ...object.Object) object.Object {
+				return puts(w, args)
+			}}
+		}
+	}
+	return builtins
+}
+
+func GetBuiltinByName(name string) *object.Builtin {
+	for _, def := range Builtins {
+		if def.Name == name {
+			return def.Builtin
+		}
+	}
+	return nil
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
+
+func builtinLen(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	switch arg := args[0].(type) {
+	case *object.Array:
+		return &object.Integer{Value: int64(len(arg.Elements))}
+	case *object.String:
+		return &object.Integer{Value: int64(len(arg.Value))}
+	default:
+		return newError("argument to `len` not supported, got %s", args[0].Type())
+	}
+}
+
+func builtinPuts(args ...object.Object) object.Object {
+	return puts(os.Stdout, args)
+}
+
+func puts(w io.Writer, args []object.Object) object.Object {
+	for _, arg := range args {
+		fmt.Fprintln(w, arg.Inspect())
+	}
+	return nil
+}
+
+func builtinFirst(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return newError("argument to `first` must be ARRAY, got %s", args[0].Type())
+	}
+
+	if len(arr.Elements) > 0 {
+		return arr.Elements[0]
+	}
+	return nil
+}
+
+func builtinLast(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return newError("argument to `last` must be ARRAY, got %s", args[0].Type())
+	}
+
+	length := len(arr.Elements)
+	if length > 0 {
+		return arr.Elements[length-1]
+	}
+	return nil
+}
+
+func builtinRest(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
+	}
+
+	length := len(arr.Elements)
+	if length == 0 {
+		return nil
+	}
+
+	newElements := make([]object.Object, length-1)
+	copy(newElements, arr.Elements[1:length])
+	return &object.Array{Elements: newElements}
+}
+
+func builtinPush(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2", len(args))
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return newError("argument to `push` must be ARRAY, got %s", args[0].Type())
+	}
+
+	length := len(arr.Elements)
+	newElements := make([]object.Object, length+1)
+	copy(newElements, arr.Elements)
+	newElements[length] = args[1]
+	return &object.Array{Elements: newElements}
+}
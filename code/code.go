@@ -13,31 +13,37 @@ func (ins Instructions) String() string {
 
 	i := 0
 	for i < len(ins) {
-		def, err := Lookup(ins[i])
+		in, err := ReadInstruction(ins, i)
 		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
-			continue
+			// operand widths are unknown -> nothing after this byte can be decoded
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", i, err)
+			break
 		}
 
-		operands, read := ReadOperands(def, ins[i+1:])
-		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
-		i += 1 + read
+		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(in))
+		i += in.Size
 	}
 	return out.String()
 }
 
-func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
+func (ins Instructions) fmtInstruction(in Instruction) string {
+	def, operands := in.Def, in.Operands
 	operandCount := len(def.OperandWidths)
 	if len(operands) != operandCount {
 		return fmt.Sprintf("ERROR: operand len %d does not match defined %d\n", len(operands), operandCount)
 	}
+
+	name := def.Name
+	if in.Wide {
+		name = "OpWide " + name
+	}
 	switch operandCount {
 	case 0:
-		return def.Name
+		return name
 	case 1:
-		return fmt.Sprintf("%s %d", def.Name, operands[0])
+		return fmt.Sprintf("%s %d", name, operands[0])
 	case 2:
-		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
+		return fmt.Sprintf("%s %d %d", name, operands[0], operands[1])
 	}
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
 }
@@ -60,6 +66,7 @@ const (
 	OpMinus
 	OpBang
 	OpJumpNotTruthy
+	OpJumpTruthy
 	OpJump
 	OpNull
 	// identifier opcode
@@ -68,16 +75,28 @@ const (
 	OpGetLocal
 	OpSetLocal
 	OpGetFree
+	OpSetFree
+	OpGetBuiltin
+	// captured variable cells
+	OpGetBoxedLocal
+	OpSetBoxedLocal
+	OpLoadLocalCell
+	OpLoadFreeCell
 	// CDT
 	OpArray
 	OpHash
 	OpIndex
+	OpSetIndex
 	// functions
 	OpCall
 	OpReturnValue
 	OpReturn
 	OpClosure
 	OpCurrentClosure
+	// prefix doubling the operand widths of the next instruction
+	OpWide
+	// copies the two values on top, receiver and index of a compound a[i] += v
+	OpDup2
 )
 
 type Definition struct {
@@ -85,6 +104,14 @@ type Definition struct {
 	OperandWidths []int
 }
 
+func (def *Definition) OperandsLen() int {
+	n := 0
+	for _, w := range def.OperandWidths {
+		n += w
+	}
+	return n
+}
+
 var definitions = map[Opcode]*Definition{
 	OpConstant:         {"OpConstant", []int{2}},
 	OpAdd:              {"OpAdd", []int{}},
@@ -101,6 +128,7 @@ var definitions = map[Opcode]*Definition{
 	OpMinus:            {"OpMinus", []int{}},
 	OpBang:             {"OpBang", []int{}},
 	OpJumpNotTruthy:    {"OpJumpNotTruthy", []int{2}},
+	OpJumpTruthy:       {"OpJumpTruthy", []int{2}},
 	OpJump:             {"OpJump", []int{2}},
 	OpNull:             {"OpNull", []int{}},
 	OpGetGlobal:        {"OpGetGlobal", []int{2}},
@@ -108,14 +136,44 @@ var definitions = map[Opcode]*Definition{
 	OpGetLocal:         {"OpGetLocal", []int{1}},
 	OpSetLocal:         {"OpSetLocal", []int{1}},
 	OpGetFree:          {"OpGetFree", []int{1}},
+	OpSetFree:          {"OpSetFree", []int{1}},
+	OpGetBuiltin:       {"OpGetBuiltin", []int{1}},
+	OpGetBoxedLocal:    {"OpGetBoxedLocal", []int{1}},
+	OpSetBoxedLocal:    {"OpSetBoxedLocal", []int{1}},
+	OpLoadLocalCell:    {"OpLoadLocalCell", []int{1}},
+	OpLoadFreeCell:     {"OpLoadFreeCell", []int{1}},
 	OpArray:            {"OpArray", []int{2}},
 	OpHash:             {"OpHash", []int{2}},
 	OpIndex:            {"OpIndex", []int{}},
+	OpSetIndex:         {"OpSetIndex", []int{}},
 	OpCall:             {"OpCall", []int{1}},
 	OpReturnValue:      {"OpReturnValue", []int{}},
 	OpReturn:           {"OpReturn", []int{}},
 	OpClosure:          {"OpClosure", []int{2, 1}},
 	OpCurrentClosure:   {"OpCurrentClosure", []int{}},
+	OpWide:             {"OpWide", []int{}},
+	OpDup2:             {"OpDup2", []int{}},
+}
+
+/*
+OpWide X lays X out with every operand twice as wide -> 1 byte operands
+take 2 and 2 byte ones take 4, lifting the 256 local/argument and 65536
+constant/jump limits where a program needs it
+*/
+var wideDefinitions = map[Opcode]*Definition{}
+
+func init() {
+	for op, def := range definitions {
+		if len(def.OperandWidths) == 0 {
+			continue
+		}
+
+		widths := make([]int, len(def.OperandWidths))
+		for i, w := range def.OperandWidths {
+			widths[i] = 2 * w
+		}
+		wideDefinitions[op] = &Definition{Name: def.Name, OperandWidths: widths}
+	}
 }
 
 func Lookup(op byte) (*Definition, error) {
@@ -126,33 +184,124 @@ func Lookup(op byte) (*Definition, error) {
 	return def, nil
 }
 
-func Make(op Opcode, operands ...int) []byte {
+// the layout of op behind an OpWide prefix, only opcodes with operands have one
+func LookupWide(op byte) (*Definition, error) {
+	def, ok := wideDefinitions[Opcode(op)]
+	if !ok {
+		if _, err := Lookup(op); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("opcode %d has no wide form", op)
+	}
+	return def, nil
+}
+
+// one decoded instruction, Size counts the OpWide prefix when Wide is set
+type Instruction struct {
+	Op       Opcode
+	Def      *Definition
+	Operands []int
+	Wide     bool
+	Size     int
+}
+
+func ReadInstruction(ins Instructions, offset int) (Instruction, error) {
+	op := ins[offset]
+	start := offset + 1
+	def, err := Lookup(op)
+	if err != nil {
+		return Instruction{}, err
+	}
+
+	wide := Opcode(op) == OpWide
+	if wide {
+		if start >= len(ins) {
+			return Instruction{}, fmt.Errorf("OpWide at end of instructions")
+		}
+		op = ins[start]
+		start++
+		if def, err = LookupWide(op); err != nil {
+			return Instruction{}, err
+		}
+	}
+
+	if start+def.OperandsLen() > len(ins) {
+		return Instruction{}, fmt.Errorf("truncated %s, want %d operand bytes, have %d", def.Name, def.OperandsLen(), len(ins)-start)
+	}
+
+	operands, read := ReadOperands(def, ins[start:])
+	return Instruction{Op: Opcode(op), Def: def, Operands: operands, Wide: wide, Size: start + read - offset}, nil
+}
+
+// by mnemonic, the name a Definition prints as
+func LookupName(name string) (Opcode, *Definition, bool) {
+	for op, def := range definitions {
+		if def.Name == name {
+			return op, def, true
+		}
+	}
+	return 0, nil, false
+}
 
+// whether operand can be encoded in width bytes
+func Fits(operand, width int) bool {
+	return operand >= 0 && uint64(operand) < 1<<(8*uint(width))
+}
+
+func Make(op Opcode, operands ...int) ([]byte, error) {
 	def, ok := definitions[op]
 	if !ok {
-		return []byte{}
+		return nil, fmt.Errorf("opcode %d undefined", op)
 	}
+	return makeInstruction(op, def, nil, operands)
+}
 
-	instructionLen := 1
-	for _, w := range def.OperandWidths {
-		instructionLen += w
+// op behind an OpWide prefix, for operands the normal layout cannot hold
+func MakeWide(op Opcode, operands ...int) ([]byte, error) {
+	def, err := LookupWide(byte(op))
+	if err != nil {
+		return nil, err
 	}
-	instruction := make([]byte, instructionLen)
-	instruction[0] = byte(op)
+	return makeInstruction(op, def, []byte{byte(OpWide)}, operands)
+}
 
-	offset := 1
+// for instructions known to fit, like the tables in tests
+func MustMake(op Opcode, operands ...int) []byte {
+	ins, err := Make(op, operands...)
+	if err != nil {
+		panic(err)
+	}
+	return ins
+}
+
+func makeInstruction(op Opcode, def *Definition, prefix []byte, operands []int) ([]byte, error) {
+	if len(operands) != len(def.OperandWidths) {
+		return nil, fmt.Errorf("%s takes %d operands, got %d", def.Name, len(def.OperandWidths), len(operands))
+	}
+
+	instruction := make([]byte, len(prefix)+1+def.OperandsLen())
+	copy(instruction, prefix)
+	instruction[len(prefix)] = byte(op)
+
+	offset := len(prefix) + 1
 	for i, o := range operands {
 		width := def.OperandWidths[i]
+		if !Fits(o, width) {
+			return nil, fmt.Errorf("operand %d of %s: %d does not fit in %d bytes", i, def.Name, o, width)
+		}
+
 		switch width {
 		case 1:
 			instruction[offset] = byte(o)
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		}
 		offset += width
 	}
 
-	return instruction
+	return instruction, nil
 }
 
 func ReadOperands(def *Definition, instruction Instructions) ([]int, int) {
@@ -165,12 +314,18 @@ func ReadOperands(def *Definition, instruction Instructions) ([]int, int) {
 			operands[i] = int(ReadUint8(instruction[offset:]))
 		case 2:
 			operands[i] = int(ReadUint16(instruction[offset:]))
+		case 4:
+			operands[i] = int(ReadUint32(instruction[offset:]))
 		}
 		offset += width
 	}
 	return operands, offset
 }
 
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
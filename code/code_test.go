@@ -18,7 +18,10 @@ func TestMake(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		instruction := Make(tt.op, tt.operands...)
+		instruction, err := Make(tt.op, tt.operands...)
+		if err != nil {
+			t.Fatalf("make error: %s", err)
+		}
 		if len(instruction) != len(tt.expected) {
 			t.Errorf("instruction has wrong length. want=%d, got=%d",
 				len(tt.expected), len(instruction))
@@ -32,13 +35,96 @@ func TestMake(t *testing.T) {
 	}
 }
 
+func TestMakeOverflow(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected string
+	}{
+		{OpConstant, []int{65536}, "operand 0 of OpConstant: 65536 does not fit in 2 bytes"},
+		{OpGetLocal, []int{256}, "operand 0 of OpGetLocal: 256 does not fit in 1 bytes"},
+		{OpClosure, []int{1, 300}, "operand 1 of OpClosure: 300 does not fit in 1 bytes"},
+		{OpCall, []int{-1}, "operand 0 of OpCall: -1 does not fit in 1 bytes"},
+		{OpConstant, []int{}, "OpConstant takes 1 operands, got 0"},
+		{Opcode(250), []int{}, "opcode 250 undefined"},
+	}
+
+	for _, tt := range tests {
+		_, err := Make(tt.op, tt.operands...)
+		if err == nil {
+			t.Errorf("expected error for %d %v but resulted in none.", tt.op, tt.operands)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestMakeWide(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+	}{
+		{OpConstant, []int{65536}, []byte{byte(OpWide), byte(OpConstant), 0, 1, 0, 0}},
+		{OpGetLocal, []int{300}, []byte{byte(OpWide), byte(OpGetLocal), 1, 44}},
+		{OpClosure, []int{70000, 256}, []byte{byte(OpWide), byte(OpClosure), 0, 1, 17, 112, 1, 0}},
+	}
+
+	for _, tt := range tests {
+		instruction, err := MakeWide(tt.op, tt.operands...)
+		if err != nil {
+			t.Fatalf("make error: %s", err)
+		}
+		if string(instruction) != string(tt.expected) {
+			t.Errorf("wrong wide instruction. want=%v, got=%v", tt.expected, instruction)
+		}
+
+		in, err := ReadInstruction(instruction, 0)
+		if err != nil {
+			t.Fatalf("read error: %s", err)
+		}
+		if in.Op != tt.op || !in.Wide || in.Size != len(tt.expected) {
+			t.Errorf("wrong decoded instruction. got=%+v", in)
+		}
+		for i, want := range tt.operands {
+			if in.Operands[i] != want {
+				t.Errorf("operand wrong. want=%d, got=%d", want, in.Operands[i])
+			}
+		}
+	}
+
+	if _, err := MakeWide(OpPop); err == nil {
+		t.Errorf("expected error for wide OpPop but resulted in none.")
+	}
+	if _, err := MakeWide(OpGetLocal, 65536); err == nil {
+		t.Errorf("expected overflow error for wide OpGetLocal but resulted in none.")
+	}
+
+	wide := Instructions(append(MustMake(OpPop), append(mustMakeWide(t, OpConstant, 70000), byte(OpWide))...))
+	expected := "0000 OpPop\n0001 OpWide OpConstant 70000\n0007 ERROR: OpWide at end of instructions\n"
+	if wide.String() != expected {
+		t.Errorf("instructions wrongly formatted.\nwant=%q\ngot=%q", expected, wide.String())
+	}
+}
+
+func mustMakeWide(t *testing.T, op Opcode, operands ...int) []byte {
+	t.Helper()
+	ins, err := MakeWide(op, operands...)
+	if err != nil {
+		t.Fatalf("make error: %s", err)
+	}
+	return ins
+}
+
 func TestInstructionsString(t *testing.T) {
 	instructions := []Instructions{
-		Make(OpAdd),
-		Make(OpConstant, 2),
-		Make(OpConstant, 65535),
-		Make(OpGetLocal, 1),
-		Make(OpClosure, 65535, 255),
+		MustMake(OpAdd),
+		MustMake(OpConstant, 2),
+		MustMake(OpConstant, 65535),
+		MustMake(OpGetLocal, 1),
+		MustMake(OpClosure, 65535, 255),
 	}
 	expected := `0000 OpAdd
 0001 OpConstant 2
@@ -77,7 +163,7 @@ func TestReadOperands(t *testing.T) {
 			t.Fatalf("definition not found: %q\n", err)
 		}
 
-		instruction := Make(tt.op, tt.operands...)
+		instruction := MustMake(tt.op, tt.operands...)
 
 		operandsRead, n := ReadOperands(def, instruction[1:])
 
@@ -92,3 +178,25 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestInstructionsStringMalformed(t *testing.T) {
+	tests := []struct {
+		ins      Instructions
+		expected string
+	}{
+		{
+			Instructions{byte(OpAdd), 0xff, byte(OpAdd)},
+			"0000 OpAdd\n0001 ERROR: opcode 255 undefined\n",
+		},
+		{
+			append(MustMake(OpPop), MustMake(OpConstant, 1)[:2]...),
+			"0000 OpPop\n0001 ERROR: truncated OpConstant, want 2 operand bytes, have 1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		if tt.ins.String() != tt.expected {
+			t.Errorf("instructions wrongly formatted.\nwant=%q\ngot=%q", tt.expected, tt.ins.String())
+		}
+	}
+}
@@ -3,20 +3,36 @@ package code
 import (
 	"fmt"
 	"monkey-i/object"
+	"strconv"
+	"strings"
 )
 
 const (
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
 	CLOSURE_OBJ           = "CLOSURE"
+	CELL_OBJ              = "CELL"
+	FLOAT_OBJ             = "FLOAT"
 )
 
 type CompiledFunction struct {
 	Instructions  Instructions
 	NumLocals     int
 	NumParameters int
+	Name          string
+	Positions     PositionTable
+	LocalNames    []string // source name of each local slot, parameters first
 }
 
 func (cf *CompiledFunction) Type() object.ObjectType { return COMPILED_FUNCTION_OBJ }
+
+// the name tracebacks, listings and reports show, function literals have none
+func (cf *CompiledFunction) DisplayName() string {
+	if cf.Name == "" {
+		return "<anonymous>"
+	}
+	return cf.Name
+}
+
 func (cf *CompiledFunction) Inspect() string {
 	return fmt.Sprintf("CompiledFunction[%p]", cf)
 }
@@ -30,3 +46,31 @@ func (cl *Closure) Type() object.ObjectType { return CLOSURE_OBJ }
 func (cl *Closure) Inspect() string {
 	return fmt.Sprintf("Closure[%p]", cl)
 }
+
+/*
+heap box for a captured variable -> the defining function and
+every closure capturing it read and write through the same cell
+*/
+type Cell struct {
+	Value object.Object
+}
+
+func (c *Cell) Type() object.ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string {
+	return fmt.Sprintf("Cell[%s]", c.Value.Inspect())
+}
+
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() object.ObjectType { return FLOAT_OBJ }
+
+// integral floats keep a trailing ".0" so they never read back as integers
+func (f *Float) Inspect() string {
+	formatted := strconv.FormatFloat(f.Value, 'f', -1, 64)
+	if strings.ContainsAny(formatted, ".IN") {
+		return formatted
+	}
+	return formatted + ".0"
+}
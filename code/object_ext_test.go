@@ -0,0 +1,23 @@
+package code
+
+import "testing"
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{0.5, "0.5"},
+		{2, "2.0"},
+		{-3, "-3.0"},
+		{1234567.25, "1234567.25"},
+		{1e21, "1000000000000000000000.0"},
+	}
+
+	for _, tt := range tests {
+		f := &Float{Value: tt.value}
+		if f.Inspect() != tt.expected {
+			t.Errorf("wrong Inspect for %v. want=%q, got=%q", tt.value, tt.expected, f.Inspect())
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package code
+
+import (
+	"fmt"
+	"sort"
+)
+
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+// lines and columns start at 1, the zero Position means unknown
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+type PositionEntry struct {
+	Offset int
+	Pos    Position
+}
+
+/*
+maps instruction offsets to source positions -> one entry per run of
+instructions sharing a position, sorted by offset
+*/
+type PositionTable []PositionEntry
+
+func (pt PositionTable) Lookup(offset int) (Position, bool) {
+	i := sort.Search(len(pt), func(i int) bool { return pt[i].Offset > offset })
+	if i == 0 {
+		return Position{}, false
+	}
+	return pt[i-1].Pos, true
+}
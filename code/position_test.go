@@ -0,0 +1,40 @@
+package code
+
+import "testing"
+
+func TestPositionTableLookup(t *testing.T) {
+	table := PositionTable{
+		{Offset: 0, Pos: Position{Line: 1, Column: 1}},
+		{Offset: 3, Pos: Position{Line: 1, Column: 9}},
+		{Offset: 7, Pos: Position{File: "a.mk", Line: 2, Column: 4}},
+	}
+
+	tests := []struct {
+		offset   int
+		expected string
+	}{
+		{0, "1:1"},
+		{2, "1:1"},
+		{3, "1:9"},
+		{6, "1:9"},
+		{7, "a.mk:2:4"},
+		{100, "a.mk:2:4"},
+	}
+
+	for _, tt := range tests {
+		pos, ok := table.Lookup(tt.offset)
+		if !ok {
+			t.Fatalf("no position for offset %d", tt.offset)
+		}
+		if pos.String() != tt.expected {
+			t.Errorf("wrong position for offset %d. want=%q, got=%q", tt.offset, tt.expected, pos)
+		}
+	}
+
+	if _, ok := (PositionTable{}).Lookup(0); ok {
+		t.Errorf("empty table should not resolve any offset")
+	}
+	if _, ok := table[1:].Lookup(0); ok {
+		t.Errorf("offset before the first entry should not resolve")
+	}
+}
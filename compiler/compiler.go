@@ -1,6 +1,7 @@
 package compiler
 
 import (
+	"errors"
 	"fmt"
 	"monkey-c/code"
 	"monkey-i/ast"
@@ -10,22 +11,58 @@ import (
 
 type Compiler struct {
 	constants   []object.Object
+	constIndex  *constantIndex
 	symbolTable *SymbolTable
 	scopes      []CompilationScope
 	scopeIndex  int
+
+	sourceFile    string
+	sourceInput   string
+	nodePositions map[ast.Node]code.Position
+	posStack      []code.Position
+
+	err      error // first instruction that could not be encoded, even in wide form
+	optimize bool  // run the peephole pass over finished scopes
+
+	statementExpression ast.Node // the expression of the statement compiled next, its value is popped right away
 }
 
 type CompilationScope struct {
 	instructions          code.Instructions
 	lastInstruction       EmittedInstruction
 	lastToLastInstruction EmittedInstruction
+	loops                 []LoopContext
+	expressionDepth       int // expressions being compiled that enclose the current node
+	positions             code.PositionTable
+	farJumps              map[int]int // jump position -> target its placeholder cannot hold
+}
+
+/*
+tracks the innermost enclosing loop of a scope -> continue jumps back to
+startPos and break jumps are backpatched once the loop end is known.
+expressionDepth is the one of the loop statement, a break or continue
+deeper than that would leave the operands of an expression on the stack
+*/
+type LoopContext struct {
+	startPos        int
+	breakJumps      []int
+	expressionDepth int
 }
 
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	Positions    code.PositionTable
+}
+
+type CompileError struct {
+	Pos code.Position
+	Err error
 }
 
+func (e *CompileError) Error() string { return e.Pos.String() + ": " + e.Err.Error() }
+func (e *CompileError) Unwrap() error { return e.Err }
+
 type EmittedInstruction struct {
 	Opcode   code.Opcode
 	Position int
@@ -38,11 +75,18 @@ func New() *Compiler {
 		lastToLastInstruction: EmittedInstruction{},
 	}
 
+	symbolTable := NewSymbolTable()
+	for i, v := range code.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
 	return &Compiler{
 		constants:   []object.Object{},
-		symbolTable: NewSymbolTable(),
+		constIndex:  newConstantIndex(),
+		symbolTable: symbolTable,
 		scopes:      []CompilationScope{mainScope},
 		scopeIndex:  0,
+		optimize:    true,
 	}
 }
 
@@ -50,10 +94,70 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	cp := New()
 	cp.symbolTable = s
 	cp.constants = constants
+	// later inputs of a REPL reuse the constants of earlier ones
+	for i, obj := range constants {
+		if _, ok := cp.constIndex.lookup(constants, obj); !ok {
+			cp.constIndex.add(obj, i)
+		}
+	}
 	return cp
 }
 
+/*
+the program compiled next came from input -> enables the position tables
+and file:line:col prefixed compile errors
+*/
+func (c *Compiler) SetSource(file, input string) {
+	c.sourceFile = file
+	c.sourceInput = input
+}
+
+/*
+the peephole pass is on by default -> turning it off keeps the bytecode
+exactly as the AST was walked, which helps when debugging the compiler
+*/
+func (c *Compiler) SetOptimize(on bool) {
+	c.optimize = on
+}
+
+/*
+every instruction emitted while compiling a node is attributed to the
+innermost node being compiled that has a known source position
+*/
 func (c *Compiler) Compile(node ast.Node) error {
+	if program, ok := node.(*ast.Program); ok && c.sourceInput != "" {
+		c.nodePositions = locatePositions(c.sourceFile, c.sourceInput, program)
+	}
+
+	if pos, ok := c.nodePositions[node]; ok {
+		c.posStack = append(c.posStack, pos)
+		defer func() { c.posStack = c.posStack[:len(c.posStack)-1] }()
+	}
+
+	statement := node == c.statementExpression
+	c.statementExpression = nil
+	if _, ok := node.(ast.Expression); ok && !statement {
+		scope := c.scopeIndex
+		c.scopes[scope].expressionDepth++
+		defer func() { c.scopes[scope].expressionDepth-- }()
+	}
+
+	err := c.compileNode(node)
+	if err == nil && c.err != nil {
+		err, c.err = c.err, nil
+	}
+	if err == nil {
+		return nil
+	}
+
+	var compileErr *CompileError
+	if errors.As(err, &compileErr) || len(c.posStack) == 0 {
+		return err
+	}
+	return &CompileError{Pos: c.posStack[len(c.posStack)-1], Err: err}
+}
+
+func (c *Compiler) compileNode(node ast.Node) error {
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, s := range node.Statements {
@@ -62,20 +166,16 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return err
 			}
 		}
+		c.finishScope()
 
 	case *ast.ExpressionStatement:
+		c.statementExpression = node.Expression
 		if err := c.Compile(node.Expression); err != nil {
 			return err
 		}
 		c.emit(code.OpPop)
 
 	case *ast.LetStatement:
-		// symbol, ok := c.symbolTable.Resolve(node.Name.Value)
-
-		// if !ok {
-		// 	symbol = c.symbolTable.Define(node.Name.Value)
-		// }
-
 		symbol := c.symbolTable.Define(node.Name.Value)
 
 		switch nodeValue := node.Value.(type) {
@@ -86,6 +186,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 				Name:          node.Name.Value,
 			}
 
+			if pos, ok := c.nodePositions[nodeValue]; ok {
+				c.nodePositions[namedFnBlock] = pos
+			}
 			node.Value = namedFnBlock
 		}
 
@@ -125,16 +228,19 @@ func (c *Compiler) Compile(node ast.Node) error {
 		// capture all the free symbols that will be used
 		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefs
+		localNames := c.symbolTable.Names()
+		c.finishScope()
+		positions := c.scopes[c.scopeIndex].positions
 		fnIns := c.leaveScope()
 
 		for _, s := range freeSymbols {
-			c.loadSymbol(s)
-			// three cases -> g => load from global; l => get from hole in stack; f => get from free index
-			// loading into free index is taken care of by vm which loads the data to the stack and copies in order to free index
+			c.loadCell(s)
+			// two cases -> l => box the hole in stack into a cell; f => pass on the cell from free index
+			// loading into free index is taken care of by vm which loads the cells to the stack and copies in order to free index
 
 		}
 
-		compiledFn := &code.CompiledFunction{Instructions: fnIns, NumLocals: numLocals, NumParameters: len(node.Parameters)}
+		compiledFn := &code.CompiledFunction{Instructions: fnIns, NumLocals: numLocals, NumParameters: len(node.Parameters), Name: node.Name, Positions: positions, LocalNames: localNames}
 		c.emit(code.OpClosure, c.addConstant(compiledFn), len(freeSymbols))
 		// functions are also being treated as global scope closures
 		//c.emit(code.OpConstant, c.addConstant(compiledFn))
@@ -161,16 +267,19 @@ func (c *Compiler) Compile(node ast.Node) error {
 		// capture all the free symbols that will be used
 		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefs
+		localNames := c.symbolTable.Names()
+		c.finishScope()
+		positions := c.scopes[c.scopeIndex].positions
 		fnIns := c.leaveScope()
 
 		for _, s := range freeSymbols {
-			c.loadSymbol(s)
-			// three cases -> g => load from global; l => get from hole in stack; f => get from free index
-			// loading into free index is taken care of by vm which loads the data to the stack and copies in order to free index
+			c.loadCell(s)
+			// two cases -> l => box the hole in stack into a cell; f => pass on the cell from free index
+			// loading into free index is taken care of by vm which loads the cells to the stack and copies in order to free index
 
 		}
 
-		compiledFn := &code.CompiledFunction{Instructions: fnIns, NumLocals: numLocals, NumParameters: len(node.Parameters)}
+		compiledFn := &code.CompiledFunction{Instructions: fnIns, NumLocals: numLocals, NumParameters: len(node.Parameters), Positions: positions, LocalNames: localNames}
 		c.emit(code.OpClosure, c.addConstant(compiledFn), len(freeSymbols))
 		// functions are also being treated as global scope closures
 		//c.emit(code.OpConstant, c.addConstant(compiledFn))
@@ -235,7 +344,15 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpIndex)
 
+	case *code.AssignExpression:
+		return c.compileAssignment(node)
+
 	case *ast.PrefixExpression:
+		if value, ok := foldConstant(node); ok {
+			c.emitConstant(value)
+			return nil
+		}
+
 		if err := c.Compile(node.Right); err != nil {
 			return err
 		}
@@ -250,6 +367,15 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogical(node)
+		}
+
+		if value, ok := foldConstant(node); ok {
+			c.emitConstant(value)
+			return nil
+		}
+
 		if node.Operator == "<" || node.Operator == "<=" {
 
 			if err := c.Compile(node.Right); err != nil {
@@ -309,10 +435,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if err := c.Compile(node.Consequence); err != nil {
 			return err
 		}
-
-		if c.lastInstructionIsPop() {
-			c.removeLastPop()
-		}
+		c.leaveBranchValue()
 
 		jumpPos := c.emit(code.OpJump, 9999)
 		afterConsequencePos := len(c.currentInstructions())
@@ -324,15 +447,55 @@ func (c *Compiler) Compile(node ast.Node) error {
 			if err := c.Compile(node.Alternative); err != nil {
 				return err
 			}
-
-			if c.lastInstructionIsPop() {
-				c.removeLastPop()
-			}
+			c.leaveBranchValue()
 		}
 
 		afterAlternativePos := len(c.currentInstructions())
 		c.performBackPatch(jumpPos, afterAlternativePos)
 
+	case *code.WhileStatement:
+		loopStartPos := len(c.currentInstructions())
+		if err := c.Compile(node.Condition); err != nil {
+			return err
+		}
+
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999) // compiler does backpatch
+		c.enterLoop(loopStartPos)
+		if err := c.Compile(node.Body); err != nil {
+			return err
+		}
+		c.emit(code.OpJump, loopStartPos)
+
+		afterLoopPos := len(c.currentInstructions())
+		c.performBackPatch(jumpNotTruthyPos, afterLoopPos)
+		for _, breakPos := range c.leaveLoop().breakJumps {
+			c.performBackPatch(breakPos, afterLoopPos)
+		}
+
+		// loops evaluate to null so they can close out a block like any expression statement
+		c.emit(code.OpNull)
+		c.emit(code.OpPop)
+
+	case *code.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("break outside of loop")
+		}
+		if loop.expressionDepth != c.scopes[c.scopeIndex].expressionDepth {
+			return fmt.Errorf("break inside an expression")
+		}
+		loop.breakJumps = append(loop.breakJumps, c.emit(code.OpJump, 9999))
+
+	case *code.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("continue outside of loop")
+		}
+		if loop.expressionDepth != c.scopes[c.scopeIndex].expressionDepth {
+			return fmt.Errorf("continue inside an expression")
+		}
+		c.emit(code.OpJump, loop.startPos)
+
 	case *ast.BlockStatement:
 		for _, s := range node.Statements {
 			if err := c.Compile(s); err != nil {
@@ -352,6 +515,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 		integer := &object.Integer{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(integer))
 
+	case *code.FloatLiteral:
+		float := &code.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
+
 	case *ast.StringLiteral:
 		str := &object.String{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(str))
@@ -368,28 +535,180 @@ func (c *Compiler) Compile(node ast.Node) error {
 	return nil
 }
 
+/*
+both arms of an if must leave exactly one value -> a block ending in a
+statement that produces none (let, empty block) yields null instead
+*/
+func (c *Compiler) leaveBranchValue() {
+	if c.lastInstructionIsPop() {
+		c.removeLastPop()
+		return
+	}
+	c.emit(code.OpNull)
+}
+
+/*
+both operands are tested with the same conditional jump and the result is a
+boolean -> && bails out to false on the first falsy operand, || to true on the
+first truthy one, so the right side only runs when it can change the result.
+the monkey-i lexer has no && or || token, such infix nodes come from Go only
+*/
+func (c *Compiler) compileLogical(node *ast.InfixExpression) error {
+	jumpOp, shortCircuitOp, fallThroughOp := code.OpJumpNotTruthy, code.OpFalse, code.OpTrue
+	if node.Operator == "||" {
+		jumpOp, shortCircuitOp, fallThroughOp = code.OpJumpTruthy, code.OpTrue, code.OpFalse
+	}
+
+	if err := c.Compile(node.Left); err != nil {
+		return err
+	}
+	leftJumpPos := c.emit(jumpOp, 9999) // compiler does backpatch
+
+	if err := c.Compile(node.Right); err != nil {
+		return err
+	}
+	rightJumpPos := c.emit(jumpOp, 9999)
+
+	c.emit(fallThroughOp)
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	shortCircuitPos := len(c.currentInstructions())
+	c.performBackPatch(leftJumpPos, shortCircuitPos)
+	c.performBackPatch(rightJumpPos, shortCircuitPos)
+	c.emit(shortCircuitOp)
+
+	c.performBackPatch(jumpPos, len(c.currentInstructions()))
+	return nil
+}
+
+var compoundAssignOps = map[string]code.Opcode{
+	"+=": code.OpAdd,
+	"-=": code.OpSub,
+	"*=": code.OpMul,
+	"/=": code.OpDiv,
+}
+
+/*
+assignments are expressions -> the assigned value is left on the stack,
+so `x = 1` is set followed by a get and `a[i] = 1` relies on OpSetIndex
+pushing the value back
+*/
+func (c *Compiler) compileAssignment(node *code.AssignExpression) error {
+	binaryOp, compound := compoundAssignOps[node.Operator]
+	if !compound && node.Operator != "=" {
+		return fmt.Errorf("unknown operator %s", node.Operator)
+	}
+
+	switch target := node.Left.(type) {
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(target.Value)
+		if !ok {
+			return fmt.Errorf("cannot assign to undefined variable %s", target.Value)
+		}
+
+		if compound {
+			c.loadSymbol(symbol)
+		}
+		if err := c.Compile(node.Right); err != nil {
+			return err
+		}
+		if compound {
+			c.emit(binaryOp)
+		}
+
+		if err := c.storeSymbol(symbol); err != nil {
+			return err
+		}
+		c.loadSymbol(symbol)
+
+	case *ast.IndexExpression:
+		if err := c.Compile(target.Left); err != nil {
+			return err
+		}
+		if err := c.Compile(target.Index); err != nil {
+			return err
+		}
+
+		// the read of a compound form reuses receiver and index, each is evaluated once
+		if compound {
+			c.emit(code.OpDup2)
+			c.emit(code.OpIndex)
+		}
+		if err := c.Compile(node.Right); err != nil {
+			return err
+		}
+		if compound {
+			c.emit(binaryOp)
+		}
+
+		c.emit(code.OpSetIndex)
+
+	default:
+		return fmt.Errorf("invalid assignment target %s", node.Left.String())
+	}
+
+	return nil
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
 	return &Bytecode{
 		Instructions: c.currentInstructions(),
 		Constants:    c.constants,
+		Positions:    c.scopes[c.scopeIndex].positions,
 	}
 }
 
+// source names of the globals, by index -> what a debugger shows for OpGetGlobal slots
+func (c *Compiler) GlobalNames() []string {
+	return c.symbolTable.Names()
+}
+
 /*
-adds the object into constant pool and returns index as location
+adds the object into constant pool and returns index as location, an equal
+constant already in the pool is reused
 */
 func (c *Compiler) addConstant(obj object.Object) int {
+	if index, ok := c.constIndex.lookup(c.constants, obj); ok {
+		return index
+	}
 	c.constants = append(c.constants, obj)
+	c.constIndex.add(obj, len(c.constants)-1)
 	return len(c.constants) - 1
 }
 
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
-	ins := code.Make(op, operands...)
+	ins := c.makeInstruction(op, operands...)
 	pos := c.addInstruction(ins)
 	c.setLastInstruction(op, pos)
+	c.recordPosition(pos)
 	return pos
 }
 
+// the wide form is only used for operands the normal one cannot hold
+func (c *Compiler) makeInstruction(op code.Opcode, operands ...int) []byte {
+	ins, err := code.Make(op, operands...)
+	if err != nil {
+		ins, err = code.MakeWide(op, operands...)
+	}
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return ins
+}
+
+func (c *Compiler) recordPosition(offset int) {
+	if len(c.posStack) == 0 {
+		return
+	}
+
+	pos := c.posStack[len(c.posStack)-1]
+	positions := c.scopes[c.scopeIndex].positions
+	if len(positions) > 0 && positions[len(positions)-1].Pos == pos {
+		return
+	}
+	c.scopes[c.scopeIndex].positions = append(positions, code.PositionEntry{Offset: offset, Pos: pos})
+}
+
 /*
 adds the bytecode into the instruction buffer and
 returns index from where said bytecode starts
@@ -426,6 +745,12 @@ func (c *Compiler) removeLastPop() {
 	new := old[:last.Position]
 	c.scopes[c.scopeIndex].instructions = new
 	c.scopes[c.scopeIndex].lastInstruction = lastToLast
+
+	positions := c.scopes[c.scopeIndex].positions
+	for len(positions) > 0 && positions[len(positions)-1].Offset >= last.Position {
+		positions = positions[:len(positions)-1]
+	}
+	c.scopes[c.scopeIndex].positions = positions
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
@@ -438,16 +763,41 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 
 func (c *Compiler) replaceLastPopWithReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
-	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
+	c.replaceInstruction(lastPos, c.makeInstruction(code.OpReturnValue))
 	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
 }
 
 func (c *Compiler) performBackPatch(opPos int, operand ...int) {
 	op := code.Opcode(c.currentInstructions()[opPos])
-	newInstruction := code.Make(op, operand...)
+	newInstruction, err := code.Make(op, operand...)
+	if err != nil {
+		// widening now would shift offsets the compiler still holds -> done once the scope is complete
+		scope := &c.scopes[c.scopeIndex]
+		if scope.farJumps == nil {
+			scope.farJumps = map[int]int{}
+		}
+		scope.farJumps[opPos] = operand[0]
+		return
+	}
 	c.replaceInstruction(opPos, newInstruction)
 }
 
+func (c *Compiler) relaxFarJumps() {
+	scope := &c.scopes[c.scopeIndex]
+	if len(scope.farJumps) == 0 {
+		return
+	}
+
+	ins, positions, err := relaxJumps(scope.instructions, scope.farJumps, scope.positions)
+	if err != nil {
+		if c.err == nil {
+			c.err = err
+		}
+		return
+	}
+	scope.instructions, scope.positions, scope.farJumps = ins, positions, nil
+}
+
 func (c *Compiler) currentInstructions() code.Instructions {
 	return c.scopes[c.scopeIndex].instructions
 }
@@ -469,12 +819,100 @@ func (c *Compiler) enterScope() {
 
 func (c *Compiler) leaveScope() code.Instructions {
 	instructions := c.currentInstructions()
+	boxCapturedLocals(instructions, c.symbolTable.CapturedLocals)
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.scopeIndex--
 	c.symbolTable = c.symbolTable.Outer
 	return instructions
 }
 
+func (c *Compiler) enterLoop(startPos int) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = append(scope.loops, LoopContext{startPos: startPos, expressionDepth: scope.expressionDepth})
+}
+
+func (c *Compiler) leaveLoop() LoopContext {
+	loops := c.scopes[c.scopeIndex].loops
+	loop := loops[len(loops)-1]
+	c.scopes[c.scopeIndex].loops = loops[:len(loops)-1]
+	return loop
+}
+
+/*
+loops are tracked per compilation scope, so a function literal
+inside a loop body cannot break out of the enclosing loop
+*/
+func (c *Compiler) currentLoop() *LoopContext {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return &loops[len(loops)-1]
+}
+
+func (c *Compiler) storeSymbol(s Symbol) error {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpSetFree, s.Index)
+	default:
+		return fmt.Errorf("cannot assign to %s", s.Name)
+	}
+	return nil
+}
+
+/*
+a local only turns out to be captured once an inner function resolves it,
+which can be after the local was already read or written -> the accesses
+are rewritten in place when its scope closes (boxed ops have the same width)
+*/
+func boxCapturedLocals(ins code.Instructions, captured map[int]bool) {
+	if len(captured) == 0 {
+		return
+	}
+
+	i := 0
+	for i < len(ins) {
+		in, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			return
+		}
+
+		if (in.Op == code.OpGetLocal || in.Op == code.OpSetLocal) && captured[in.Operands[0]] {
+			opAt := i
+			if in.Wide {
+				opAt++
+			}
+
+			if in.Op == code.OpGetLocal {
+				ins[opAt] = byte(code.OpGetBoxedLocal)
+			} else {
+				ins[opAt] = byte(code.OpSetBoxedLocal)
+			}
+		}
+
+		i += in.Size
+	}
+}
+
+/*
+pushes what a closure stores in its free slot for the symbol -> always a cell,
+except for the enclosing function itself which the vm boxes when building the closure
+*/
+func (c *Compiler) loadCell(s Symbol) {
+	switch s.Scope {
+	case LocalScope:
+		c.emit(code.OpLoadLocalCell, s.Index)
+	case FreeScope:
+		c.emit(code.OpLoadFreeCell, s.Index)
+	default:
+		c.loadSymbol(s)
+	}
+}
+
 func (c *Compiler) loadSymbol(s Symbol) {
 	switch s.Scope {
 	case GlobalScope:
@@ -485,5 +923,7 @@ func (c *Compiler) loadSymbol(s Symbol) {
 		c.emit(code.OpGetFree, s.Index)
 	case FunctionScope:
 		c.emit(code.OpCurrentClosure)
+	case BuiltinScope:
+		c.emit(code.OpGetBuiltin, s.Index)
 	}
 }
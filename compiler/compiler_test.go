@@ -3,82 +3,73 @@ package compiler
 import (
 	"fmt"
 	"monkey-c/code"
+	"monkey-c/internal/asttest"
 	"monkey-i/ast"
 	"monkey-i/lexer"
 	"monkey-i/object"
 	"monkey-i/parser"
+	"reflect"
 	"testing"
 )
 
 type compilerTestCase struct {
 	input                string
+	program              *ast.Program // set for syntax the parser cannot produce yet
 	expectedConstants    []interface{}
 	expectedInstructions []code.Instructions
+	optimize             bool // the expectations are the code as walked unless set
 }
 
 func TestIntCalculation(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input:             "1 + 2",
-			expectedConstants: []interface{}{1, 2},
+			expectedConstants: []interface{}{3},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
 			},
 		},
 		{
 			input:             "1; 2",
 			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpPop),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpPop),
 			},
 		},
 		{
 			input:             "1 * 2",
-			expectedConstants: []interface{}{1, 2},
+			expectedConstants: []interface{}{2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpMul),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
 			},
 		},
 		{
 			input:             "1 + 2 * 3",
-			expectedConstants: []interface{}{1, 2, 3},
+			expectedConstants: []interface{}{7},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpMul),
-				code.Make(code.OpAdd),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
 			},
 		},
 		{
 			input:             "1 * 2 + 3",
-			expectedConstants: []interface{}{1, 2, 3},
+			expectedConstants: []interface{}{5},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpMul),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpAdd),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
 			},
 		},
 		{
 			input:             "-1",
-			expectedConstants: []interface{}{1},
+			expectedConstants: []interface{}{-1},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpMinus),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
 			},
 		},
 	}
@@ -92,50 +83,43 @@ func TestBooleanExpressions(t *testing.T) {
 			input:             "true",
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpTrue),
+				code.MustMake(code.OpPop),
 			},
 		}, {
 			input: "false", expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpFalse),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpFalse),
+				code.MustMake(code.OpPop),
 			},
 		},
 		{
 			input:             "1 > 2",
-			expectedConstants: []interface{}{1, 2},
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpFalse),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input:             "1 < 2",
-			expectedConstants: []interface{}{2, 1},
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpTrue),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input:             "1 == 2",
-			expectedConstants: []interface{}{1, 2},
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpEqual),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpFalse),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input:             "!true",
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpBang),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpFalse),
+				code.MustMake(code.OpPop),
 			}},
 	}
 
@@ -149,21 +133,21 @@ func TestConditionals(t *testing.T) {
 			expectedConstants: []interface{}{10, 3333},
 			expectedInstructions: []code.Instructions{
 				// 0000
-				code.Make(code.OpTrue),
+				code.MustMake(code.OpTrue),
 				// 0001
-				code.Make(code.OpJumpNotTruthy, 10),
+				code.MustMake(code.OpJumpNotTruthy, 10),
 				// 0004
-				code.Make(code.OpConstant, 0),
+				code.MustMake(code.OpConstant, 0),
 				// 0007
-				code.Make(code.OpJump, 11),
+				code.MustMake(code.OpJump, 11),
 				// 0010
-				code.Make(code.OpNull),
+				code.MustMake(code.OpNull),
 				// 0011
-				code.Make(code.OpPop),
+				code.MustMake(code.OpPop),
 				// 0012
-				code.Make(code.OpConstant, 1),
+				code.MustMake(code.OpConstant, 1),
 				// 0015
-				code.Make(code.OpPop),
+				code.MustMake(code.OpPop),
 			},
 		},
 		{
@@ -171,20 +155,90 @@ func TestConditionals(t *testing.T) {
 			expectedConstants: []interface{}{10, 20, 3333},
 			expectedInstructions: []code.Instructions{
 				// 0000
-				code.Make(code.OpTrue),
+				code.MustMake(code.OpTrue),
 				// 0001
-				code.Make(code.OpJumpNotTruthy, 10), // 0004
-				code.Make(code.OpConstant, 0),
+				code.MustMake(code.OpJumpNotTruthy, 10), // 0004
+				code.MustMake(code.OpConstant, 0),
 				// 0007
-				code.Make(code.OpJump, 13),
+				code.MustMake(code.OpJump, 13),
 				// 0010
-				code.Make(code.OpConstant, 1),
+				code.MustMake(code.OpConstant, 1),
 				// 0013
-				code.Make(code.OpPop),
+				code.MustMake(code.OpPop),
 				// 0014
-				code.Make(code.OpConstant, 2),
+				code.MustMake(code.OpConstant, 2),
 				// 0017
-				code.Make(code.OpPop),
+				code.MustMake(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+// both arms of an if leave exactly one value, a branch ending without one yields null
+func TestIfBranchValues(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `if (true) { let x = 1; };`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpTrue),
+				// 0001
+				code.MustMake(code.OpJumpNotTruthy, 14),
+				// 0004
+				code.MustMake(code.OpConstant, 0),
+				// 0007
+				code.MustMake(code.OpSetGlobal, 0),
+				// 0010
+				code.MustMake(code.OpNull),
+				// 0011
+				code.MustMake(code.OpJump, 15),
+				// 0014
+				code.MustMake(code.OpNull),
+				// 0015
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			input:             `if (false) { 1 } else { let y = 2; };`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpFalse),
+				// 0001
+				code.MustMake(code.OpJumpNotTruthy, 10),
+				// 0004
+				code.MustMake(code.OpConstant, 0),
+				// 0007
+				code.MustMake(code.OpJump, 17),
+				// 0010
+				code.MustMake(code.OpConstant, 1),
+				// 0013
+				code.MustMake(code.OpSetGlobal, 0),
+				// 0016
+				code.MustMake(code.OpNull),
+				// 0017
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			input:             `if (true) { };`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpTrue),
+				// 0001
+				code.MustMake(code.OpJumpNotTruthy, 8),
+				// 0004
+				code.MustMake(code.OpNull),
+				// 0005
+				code.MustMake(code.OpJump, 9),
+				// 0008
+				code.MustMake(code.OpNull),
+				// 0009
+				code.MustMake(code.OpPop),
 			},
 		},
 	}
@@ -200,10 +254,10 @@ func TestGlobalLetStatements(t *testing.T) {
 	let two = 2;
 	`,
 			expectedConstants: []interface{}{1, 2}, expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSetGlobal, 1),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpSetGlobal, 1),
 			}},
 		{
 			input: `
@@ -211,10 +265,10 @@ func TestGlobalLetStatements(t *testing.T) {
 	one;
 	`,
 			expectedConstants: []interface{}{1}, expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input: `
@@ -223,12 +277,12 @@ func TestGlobalLetStatements(t *testing.T) {
 	two;
 	`,
 			expectedConstants: []interface{}{1}, expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpSetGlobal, 1),
-				code.Make(code.OpGetGlobal, 1),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpSetGlobal, 1),
+				code.MustMake(code.OpGetGlobal, 1),
+				code.MustMake(code.OpPop),
 			}},
 	}
 
@@ -241,21 +295,85 @@ func TestStringExprs(t *testing.T) {
 			input:             `"monkey"`,
 			expectedConstants: []interface{}{"monkey"},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
 			},
 		},
 		{
 			input:             `"mon" + "key"`,
-			expectedConstants: []interface{}{"mon", "key"},
+			expectedConstants: []interface{}{"monkey"},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestConstantFolding(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "(2 + 3) * (10 - 4) / 2 - -1",
+			expectedConstants: []interface{}{16},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			input:             `!(1 < 2) == !5; "a" + "b" + "c"`,
+			expectedConstants: []interface{}{"abc"},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpTrue),
+				code.MustMake(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			// division by zero stays a runtime error, the dividend still folds
+			input:             "(4 + 6) / 0",
+			expectedConstants: []interface{}{10, 0},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpDiv),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 1; x + 2 * 3",
+			expectedConstants: []interface{}{1, 6},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpAdd),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			// type errors and string comparisons are left to the VM
+			input:             `-true; 1 == true; "a" == "a"`,
+			expectedConstants: []interface{}{1, "a"},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpTrue),
+				code.MustMake(code.OpMinus),
+				code.MustMake(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpTrue),
+				code.MustMake(code.OpEqual),
+				code.MustMake(code.OpPop),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpEqual),
+				code.MustMake(code.OpPop),
 			},
 		},
 	}
+
 	runCompilerTests(t, tests)
 }
 
@@ -263,31 +381,25 @@ func TestArrayLiterals(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input: "[]", expectedConstants: []interface{}{}, expectedInstructions: []code.Instructions{
-				code.Make(code.OpArray, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpArray, 0),
+				code.MustMake(code.OpPop),
 			},
 		}, {
 			input: "[1, 2, 3]", expectedConstants: []interface{}{1, 2, 3}, expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpConstant, 2),
+				code.MustMake(code.OpArray, 3),
+				code.MustMake(code.OpPop),
 			}},
 
 		{
-			input: "[1 + 2, 3 - 4, 5 * 6]", expectedConstants: []interface{}{1, 2, 3, 4, 5, 6}, expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSub),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpMul),
-				code.Make(code.OpArray, 3),
-				code.Make(code.OpPop),
+			input: "[1 + 2, 3 - 4, 5 * 6]", expectedConstants: []interface{}{3, -1, 30}, expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpConstant, 2),
+				code.MustMake(code.OpArray, 3),
+				code.MustMake(code.OpPop),
 			}},
 	}
 
@@ -300,36 +412,32 @@ func TestHashLiterals(t *testing.T) {
 			input:             "{}",
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpHash, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpHash, 0),
+				code.MustMake(code.OpPop),
 			},
 		}, {
 			input:             "{1: 2, 3: 4, 5: 6}",
 			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpHash, 6),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpConstant, 2),
+				code.MustMake(code.OpConstant, 3),
+				code.MustMake(code.OpConstant, 4),
+				code.MustMake(code.OpConstant, 5),
+				code.MustMake(code.OpHash, 6),
+				code.MustMake(code.OpPop),
 			},
 		}, {
 			input:             "{1: 2 + 3, 4: 5 * 6}",
-			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			expectedConstants: []interface{}{1, 5, 4, 30},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpMul),
-				code.Make(code.OpHash, 4),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpConstant, 2),
+				code.MustMake(code.OpConstant, 3),
+				code.MustMake(code.OpHash, 4),
+				code.MustMake(code.OpPop),
 			}},
 	}
 
@@ -341,54 +449,48 @@ func TestFunctions(t *testing.T) {
 		{
 			input: `fn() { return 5 + 10 }`,
 			expectedConstants: []interface{}{
-				5,
-				10,
+				15,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpReturnValue),
 				}},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 1, 0),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input: `fn() { 5 + 10 }`, expectedConstants: []interface{}{
-				5,
-				10,
+				15,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpReturnValue),
 				}},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 1, 0),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input: `fn() { 1; 2 }`, expectedConstants: []interface{}{
 				1,
 				2,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpPop),
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpPop),
+					code.MustMake(code.OpConstant, 1),
+					code.MustMake(code.OpReturnValue),
 				}},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 2, 0),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input: `fn() { }`, expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpReturn),
+					code.MustMake(code.OpReturn),
 				}},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 0, 0),
+				code.MustMake(code.OpPop),
 			}},
 	}
 
@@ -401,30 +503,30 @@ func TestFunctionCalls(t *testing.T) {
 			input: `fn() { 24 }();`, expectedConstants: []interface{}{
 				24,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0), // The literal "24"
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpConstant, 0), // The literal "24"
+					code.MustMake(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0), // The compiled function
-				code.Make(code.OpCall, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 1, 0), // The compiled function
+				code.MustMake(code.OpCall, 0),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input: `let noArg = fn() { 24 }; noArg();`,
 			expectedConstants: []interface{}{
 				24,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0), // The literal "24"
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpConstant, 0), // The literal "24"
+					code.MustMake(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0), // The compiled function
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpCall, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 1, 0), // The compiled function
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpCall, 0),
+				code.MustMake(code.OpPop),
 			},
 		},
 		{
@@ -433,17 +535,17 @@ func TestFunctionCalls(t *testing.T) {
 			`,
 			expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpReturnValue),
 				},
 				24},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpCall, 1),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 0, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpCall, 1),
+				code.MustMake(code.OpPop),
 			},
 		},
 		{
@@ -452,23 +554,23 @@ func TestFunctionCalls(t *testing.T) {
 			`,
 			expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpPop),
-					code.Make(code.OpGetLocal, 1),
-					code.Make(code.OpPop),
-					code.Make(code.OpGetLocal, 2),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpPop),
+					code.MustMake(code.OpGetLocal, 1),
+					code.MustMake(code.OpPop),
+					code.MustMake(code.OpGetLocal, 2),
+					code.MustMake(code.OpReturnValue),
 				}, 24, 25, 26,
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpCall, 3),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 0, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpConstant, 2),
+				code.MustMake(code.OpConstant, 3),
+				code.MustMake(code.OpCall, 3),
+				code.MustMake(code.OpPop),
 			},
 		},
 	}
@@ -543,16 +645,16 @@ func TestLetStatementScopes(t *testing.T) {
 		{input: `let a=1; let b=2; let c=a+b; c`,
 			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSetGlobal, 1),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpGetGlobal, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpSetGlobal, 2),
-				code.Make(code.OpGetGlobal, 2),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpSetGlobal, 1),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 1),
+				code.MustMake(code.OpAdd),
+				code.MustMake(code.OpSetGlobal, 2),
+				code.MustMake(code.OpGetGlobal, 2),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input: `
@@ -562,15 +664,15 @@ func TestLetStatementScopes(t *testing.T) {
 			expectedConstants: []interface{}{
 				55,
 				[]code.Instructions{
-					code.Make(code.OpGetGlobal, 0),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpGetGlobal, 0),
+					code.MustMake(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpClosure, 1, 0),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input: `fn() {
@@ -580,14 +682,14 @@ func TestLetStatementScopes(t *testing.T) {
 			expectedConstants: []interface{}{
 				55,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpSetLocal, 0),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpReturnValue),
 				}},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 1, 0),
+				code.MustMake(code.OpPop),
 			}},
 		{
 			input: `fn() {
@@ -599,18 +701,18 @@ func TestLetStatementScopes(t *testing.T) {
 				55,
 				77,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpSetLocal, 1),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpGetLocal, 1),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpSetLocal, 0),
+					code.MustMake(code.OpConstant, 1),
+					code.MustMake(code.OpSetLocal, 1),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpGetLocal, 1),
+					code.MustMake(code.OpAdd),
+					code.MustMake(code.OpReturnValue),
 				}},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 2, 0),
+				code.MustMake(code.OpPop),
 			}},
 	}
 	runCompilerTests(t, tests)
@@ -619,27 +721,23 @@ func TestLetStatementScopes(t *testing.T) {
 func TestIndexExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input: "[1, 2, 3][1 + 1]", expectedConstants: []interface{}{1, 2, 3, 1, 1}, expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpAdd),
-				code.Make(code.OpIndex),
-				code.Make(code.OpPop),
+			input: "[1, 2, 3][1 + 1]", expectedConstants: []interface{}{1, 2, 3}, expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpConstant, 2),
+				code.MustMake(code.OpArray, 3),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpIndex),
+				code.MustMake(code.OpPop),
 			}},
 		{
-			input: "{1: 2}[2 - 1]", expectedConstants: []interface{}{1, 2, 2, 1}, expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpHash, 2),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSub),
-				code.Make(code.OpIndex),
-				code.Make(code.OpPop),
+			input: "{1: 2}[2 - 1]", expectedConstants: []interface{}{1, 2}, expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpHash, 2),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpIndex),
+				code.MustMake(code.OpPop),
 			}},
 	}
 
@@ -649,8 +747,12 @@ func TestIndexExpressions(t *testing.T) {
 func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
 	for _, tt := range tests {
-		program := parse(tt.input)
+		program := tt.program
+		if program == nil {
+			program = parse(tt.input)
+		}
 		compiler := New()
+		compiler.SetOptimize(tt.optimize)
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
@@ -710,6 +812,10 @@ func testConstants(expected []interface{}, actual []object.Object) error {
 			if err != nil {
 				return fmt.Errorf("constant %d - testIntegerObject failed: %s", i, err)
 			}
+		case float64:
+			if err := testFloatObject(constant, actual[i]); err != nil {
+				return fmt.Errorf("constant %d - testFloatObject failed: %s", i, err)
+			}
 		case string:
 			if err := testStringObject(constant, actual[i]); err != nil {
 				return fmt.Errorf("constant %d - testStringObject failed: %s", i, err)
@@ -739,6 +845,17 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*code.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+	}
+	return nil
+}
+
 func testStringObject(expected string, actual object.Object) error {
 	res, ok := actual.(*object.String)
 	if !ok {
@@ -756,43 +873,43 @@ func TestClosures(t *testing.T) {
 			input: `fn(a) {fn(b) { a+b } }`,
 			expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpGetFree, 0),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpAdd),
+					code.MustMake(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 0, 1),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpLoadLocalCell, 0),
+					code.MustMake(code.OpClosure, 0, 1),
+					code.MustMake(code.OpReturnValue),
 				}},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 1, 0),
+				code.MustMake(code.OpPop),
 			}}, {
 			input: `fn(a) { fn(b) { fn(c) {a+b+c } } }`,
 			expectedConstants: []interface{}{[]code.Instructions{
-				code.Make(code.OpGetFree, 0),
-				code.Make(code.OpGetFree, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpGetLocal, 0),
-				code.Make(code.OpAdd),
-				code.Make(code.OpReturnValue),
+				code.MustMake(code.OpGetFree, 0),
+				code.MustMake(code.OpGetFree, 1),
+				code.MustMake(code.OpAdd),
+				code.MustMake(code.OpGetLocal, 0),
+				code.MustMake(code.OpAdd),
+				code.MustMake(code.OpReturnValue),
 			},
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 0, 2),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpLoadFreeCell, 0),
+					code.MustMake(code.OpLoadLocalCell, 0),
+					code.MustMake(code.OpClosure, 0, 2),
+					code.MustMake(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 1, 1),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpLoadLocalCell, 0),
+					code.MustMake(code.OpClosure, 1, 1),
+					code.MustMake(code.OpReturnValue),
 				}},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop)},
+				code.MustMake(code.OpClosure, 2, 0),
+				code.MustMake(code.OpPop)},
 		},
 		{
 			input: `
@@ -805,28 +922,27 @@ func TestClosures(t *testing.T) {
 			expectedConstants: []interface{}{
 				1,
 				[]code.Instructions{
-					code.Make(code.OpCurrentClosure),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpCurrentClosure),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpSub),
+					code.MustMake(code.OpCall, 1),
+					code.MustMake(code.OpReturnValue),
 				},
-				1,
 				[]code.Instructions{
-					code.Make(code.OpClosure, 1, 0),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpConstant, 2),
-					code.Make(code.OpCall, 1),
-					code.Make(code.OpReturnValue),
+					code.MustMake(code.OpClosure, 1, 0),
+					code.MustMake(code.OpSetLocal, 0),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpCall, 1),
+					code.MustMake(code.OpReturnValue),
 				}},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 3, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpCall, 0),
-				code.Make(code.OpPop),
+				code.MustMake(code.OpClosure, 2, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpCall, 0),
+				code.MustMake(code.OpPop),
 			}},
 	}
 	runCompilerTests(t, tests)
@@ -841,22 +957,835 @@ func TestRecursiveFunctions(t *testing.T) {
 			expectedConstants: []interface{}{
 				1,
 				[]code.Instructions{
-					code.Make(code.OpCurrentClosure),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
-					code.Make(code.OpReturnValue),
-				},
-				1},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpCall, 1),
-				code.Make(code.OpPop),
+					code.MustMake(code.OpCurrentClosure),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpSub),
+					code.MustMake(code.OpCall, 1),
+					code.MustMake(code.OpReturnValue),
+				}},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpClosure, 1, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpCall, 1),
+				code.MustMake(code.OpPop),
 			}},
 	}
 	runCompilerTests(t, tests)
 }
+
+func TestBuiltins(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			len([]);
+			push([], 1);
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpGetBuiltin, 0),
+				code.MustMake(code.OpArray, 0),
+				code.MustMake(code.OpCall, 1),
+				code.MustMake(code.OpPop),
+				code.MustMake(code.OpGetBuiltin, 5),
+				code.MustMake(code.OpArray, 0),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpCall, 2),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { len([]) }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.MustMake(code.OpGetBuiltin, 0),
+					code.MustMake(code.OpArray, 0),
+					code.MustMake(code.OpCall, 1),
+					code.MustMake(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpClosure, 0, 0),
+				code.MustMake(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			program:           asttest.Program(asttest.While("true", asttest.Stmts("1;")...)),
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpTrue),
+				// 0001
+				code.MustMake(code.OpJumpNotTruthy, 11),
+				// 0004
+				code.MustMake(code.OpConstant, 0),
+				// 0007
+				code.MustMake(code.OpPop),
+				// 0008
+				code.MustMake(code.OpJump, 0),
+				// 0011
+				code.MustMake(code.OpNull),
+				// 0012
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			program:           asttest.Program(asttest.While("true", asttest.Break(), asttest.Continue())),
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpTrue),
+				// 0001
+				code.MustMake(code.OpJumpNotTruthy, 13),
+				// 0004
+				code.MustMake(code.OpJump, 13),
+				// 0007
+				code.MustMake(code.OpJump, 0),
+				// 0010
+				code.MustMake(code.OpJump, 0),
+				// 0013
+				code.MustMake(code.OpNull),
+				// 0014
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			program: asttest.Program(
+				asttest.While("true",
+					asttest.While("false", asttest.Break()),
+					asttest.Break(),
+				),
+			),
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpTrue),
+				// 0001
+				code.MustMake(code.OpJumpNotTruthy, 22),
+				// 0004
+				code.MustMake(code.OpFalse),
+				// 0005
+				code.MustMake(code.OpJumpNotTruthy, 14),
+				// 0008
+				code.MustMake(code.OpJump, 14),
+				// 0011
+				code.MustMake(code.OpJump, 4),
+				// 0014
+				code.MustMake(code.OpNull),
+				// 0015
+				code.MustMake(code.OpPop),
+				// 0016
+				code.MustMake(code.OpJump, 22),
+				// 0019
+				code.MustMake(code.OpJump, 0),
+				// 0022
+				code.MustMake(code.OpNull),
+				// 0023
+				code.MustMake(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLoopControlOutsideLoop(t *testing.T) {
+	fnWithBreak := asttest.Expr("fn() { }").(*ast.FunctionBlock)
+	fnWithBreak.Body.Statements = []ast.Statement{asttest.Break()}
+
+	tests := []struct {
+		program  *ast.Program
+		expected string
+	}{
+		{asttest.Program(asttest.Break()), "break outside of loop"},
+		{asttest.Program(asttest.Continue()), "continue outside of loop"},
+		{
+			asttest.Program(asttest.While("true", &ast.ExpressionStatement{Expression: fnWithBreak})),
+			"break outside of loop",
+		},
+		{
+			// while (true) { 1 + if (true) { break; } }
+			asttest.Program(asttest.While("true", asttest.ExprStmt(asttest.Infix(asttest.Expr("1"), "+", asttest.If("true", asttest.Break()).Expression)))),
+			"break inside an expression",
+		},
+		{
+			// while (true) { let x = if (true) { continue; } }
+			asttest.Program(asttest.While("true", asttest.Let("x", asttest.If("true", asttest.Continue()).Expression))),
+			"continue inside an expression",
+		},
+	}
+
+	for _, tt := range tests {
+		err := New().Compile(tt.program)
+		if err == nil {
+			t.Fatalf("expected compiler error but resulted in none.")
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			program:           asttest.Program(append(asttest.Stmts("let x = 1;"), asttest.Assign("x", "=", "2"))...),
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			program:           asttest.Program(append(asttest.Stmts("let x = 1;"), asttest.Assign("x", "+=", "2"))...),
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpAdd),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			program: asttest.Program(&ast.ExpressionStatement{Expression: &ast.FunctionBlock{
+				Body: asttest.Block(append(asttest.Stmts("let a = 1;"), asttest.Assign("a", "*=", "3"))...),
+			}}),
+			expectedConstants: []interface{}{
+				1,
+				3,
+				[]code.Instructions{
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpSetLocal, 0),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpConstant, 1),
+					code.MustMake(code.OpMul),
+					code.MustMake(code.OpSetLocal, 0),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpClosure, 2, 0),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			program:           asttest.Program(append(asttest.Stmts("let arr = [1];"), asttest.Assign("arr[0]", "=", "5"))...),
+			expectedConstants: []interface{}{1, 0, 5},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpArray, 1),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpConstant, 2),
+				code.MustMake(code.OpSetIndex),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			program:           asttest.Program(append(asttest.Stmts("let arr = [1];"), asttest.Assign("arr[0]", "-=", "5"))...),
+			expectedConstants: []interface{}{1, 0, 5},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpArray, 1),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpDup2),
+				code.MustMake(code.OpIndex),
+				code.MustMake(code.OpConstant, 2),
+				code.MustMake(code.OpSub),
+				code.MustMake(code.OpSetIndex),
+				code.MustMake(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestInvalidAssignments(t *testing.T) {
+	tests := []struct {
+		program  *ast.Program
+		expected string
+	}{
+		{asttest.Program(asttest.Assign("y", "=", "1")), "cannot assign to undefined variable y"},
+		{asttest.Program(asttest.Assign("len", "=", "1")), "cannot assign to len"},
+		{asttest.Program(asttest.Assign("1", "=", "2")), "invalid assignment target 1"},
+		{asttest.Program(append(asttest.Stmts("let x = 1;"), asttest.Assign("x", "%=", "2"))...), "unknown operator %="},
+	}
+
+	for _, tt := range tests {
+		err := New().Compile(tt.program)
+		if err == nil {
+			t.Fatalf("expected compiler error but resulted in none.")
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestMutableClosures(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn() { let a = 1; fn() { a }; a }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.MustMake(code.OpGetFree, 0),
+					code.MustMake(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpSetBoxedLocal, 0),
+					code.MustMake(code.OpLoadLocalCell, 0),
+					code.MustMake(code.OpClosure, 1, 1),
+					code.MustMake(code.OpPop),
+					code.MustMake(code.OpGetBoxedLocal, 0),
+					code.MustMake(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpClosure, 2, 0),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			program: asttest.Program(&ast.ExpressionStatement{Expression: &ast.FunctionBlock{
+				Body: asttest.Block(append(asttest.Stmts("let a = 1;"), &ast.ExpressionStatement{Expression: &ast.FunctionBlock{
+					Body: asttest.Block(asttest.Assign("a", "=", "2")),
+				}})...),
+			}}),
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.MustMake(code.OpConstant, 1),
+					code.MustMake(code.OpSetFree, 0),
+					code.MustMake(code.OpGetFree, 0),
+					code.MustMake(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpSetBoxedLocal, 0),
+					code.MustMake(code.OpLoadLocalCell, 0),
+					code.MustMake(code.OpClosure, 2, 1),
+					code.MustMake(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpClosure, 3, 0),
+				code.MustMake(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			program:           asttest.Program(&ast.ExpressionStatement{Expression: asttest.Logical("true", "&&", "false")}),
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpTrue),
+				// 0001
+				code.MustMake(code.OpJumpNotTruthy, 12),
+				// 0004
+				code.MustMake(code.OpFalse),
+				// 0005
+				code.MustMake(code.OpJumpNotTruthy, 12),
+				// 0008
+				code.MustMake(code.OpTrue),
+				// 0009
+				code.MustMake(code.OpJump, 13),
+				// 0012
+				code.MustMake(code.OpFalse),
+				// 0013
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			program:           asttest.Program(&ast.ExpressionStatement{Expression: asttest.Logical("1", "||", "2")}),
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpConstant, 0),
+				// 0003
+				code.MustMake(code.OpJumpTruthy, 16),
+				// 0006
+				code.MustMake(code.OpConstant, 1),
+				// 0009
+				code.MustMake(code.OpJumpTruthy, 16),
+				// 0012
+				code.MustMake(code.OpFalse),
+				// 0013
+				code.MustMake(code.OpJump, 17),
+				// 0016
+				code.MustMake(code.OpTrue),
+				// 0017
+				code.MustMake(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFloatLiterals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			program:           asttest.Program(&ast.ExpressionStatement{Expression: asttest.Infix(asttest.Float("0.5"), "+", asttest.Expr("1"))}),
+			expectedConstants: []interface{}{0.5, 1},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpAdd),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			program:           asttest.Program(&ast.ExpressionStatement{Expression: &ast.PrefixExpression{Operator: "-", Right: asttest.Float("2.25")}}),
+			expectedConstants: []interface{}{2.25},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpMinus),
+				code.MustMake(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompileErrorPositions(t *testing.T) {
+	input := "let x = 1;\nlet y = x + z;"
+
+	comp := New()
+	comp.SetSource("test.mk", input)
+	err := comp.Compile(parse(input))
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none.")
+	}
+
+	compileErr, ok := err.(*CompileError)
+	if !ok {
+		t.Fatalf("error is not *CompileError. got=%T (%v)", err, err)
+	}
+	expected := "test.mk:2:13: undefined variable z"
+	if compileErr.Error() != expected {
+		t.Errorf("wrong compiler error. want=%q, got=%q", expected, compileErr)
+	}
+}
+
+func TestPositionTables(t *testing.T) {
+	input := "let a = 1;\nlet b = fn(x) {\n  x * a\n};"
+
+	comp := New()
+	comp.SetSource("", input)
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expectedMain := code.PositionTable{
+		{Offset: 0, Pos: code.Position{Line: 1, Column: 9}},
+		{Offset: 3, Pos: code.Position{Line: 1, Column: 1}},
+		{Offset: 6, Pos: code.Position{Line: 2, Column: 9}},
+		{Offset: 10, Pos: code.Position{Line: 2, Column: 1}},
+	}
+	expectedFn := code.PositionTable{
+		{Offset: 0, Pos: code.Position{Line: 3, Column: 3}},
+		{Offset: 2, Pos: code.Position{Line: 3, Column: 7}},
+		{Offset: 5, Pos: code.Position{Line: 3, Column: 5}},
+	}
+
+	bytecode := comp.Bytecode()
+	if err := testPositions(expectedMain, bytecode.Positions); err != nil {
+		t.Errorf("main: %s", err)
+	}
+
+	fn, ok := bytecode.Constants[1].(*code.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 1 is not CompiledFunction. got=%T", bytecode.Constants[1])
+	}
+	if err := testPositions(expectedFn, fn.Positions); err != nil {
+		t.Errorf("fn: %s", err)
+	}
+}
+
+func TestLocalNames(t *testing.T) {
+	input := "let g = 1; let f = fn(a, b) { let c = a; let d = fn(e) { e + c }; d(b) };"
+
+	comp := New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	if names := comp.GlobalNames(); !reflect.DeepEqual(names, []string{"g", "f"}) {
+		t.Errorf("wrong global names. got=%v", names)
+	}
+
+	expected := map[string][]string{"f": {"a", "b", "c", "d"}, "d": {"e"}}
+	for _, constant := range comp.Bytecode().Constants {
+		fn, ok := constant.(*code.CompiledFunction)
+		if !ok {
+			continue
+		}
+		if !reflect.DeepEqual(fn.LocalNames, expected[fn.Name]) {
+			t.Errorf("wrong local names of %q. want=%v, got=%v", fn.Name, expected[fn.Name], fn.LocalNames)
+		}
+	}
+}
+
+func TestConstantDeduplication(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `"ok"; 7; "ok"; 7`,
+			expectedConstants: []interface{}{"ok", 7},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpPop),
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpPop),
+			},
+		},
+		{
+			input: `[fn(x) { x + 1 }, fn(x) { x + 1 }, fn(y) { y + 1 }]`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpAdd),
+					code.MustMake(code.OpReturnValue),
+				},
+				// same code, but the debugger shows another local name
+				[]code.Instructions{
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpAdd),
+					code.MustMake(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpClosure, 1, 0),
+				code.MustMake(code.OpClosure, 1, 0),
+				code.MustMake(code.OpClosure, 2, 0),
+				code.MustMake(code.OpArray, 3),
+				code.MustMake(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConstantsAcrossInputs(t *testing.T) {
+	// functions from different places in the source are kept apart for their positions
+	input := `[fn() { "ok" }, fn() { "ok" }]`
+	comp := New()
+	comp.SetSource("", input)
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+	if err := testConstants([]interface{}{"ok", []code.Instructions{
+		code.MustMake(code.OpConstant, 0),
+		code.MustMake(code.OpReturnValue),
+	}, []code.Instructions{
+		code.MustMake(code.OpConstant, 0),
+		code.MustMake(code.OpReturnValue),
+	}}, bytecode.Constants); err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+
+	// the next input of a REPL reuses what the pool has, the same line again adds nothing
+	symbolTable := NewSymbolTable()
+	for _, input := range []string{`let s = "ok"; 1`, `let t = "ok"; 1; 2`, `let t = "ok"; 1; 2`} {
+		comp := NewWithState(symbolTable, bytecode.Constants)
+		comp.SetSource("", input)
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode = comp.Bytecode()
+	}
+	if err := testConstants([]interface{}{"ok", nil, nil, 1, 2}, bytecode.Constants); err != nil {
+		t.Errorf("testConstants failed: %s", err)
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// the condition never jumps, the consequence falls through to the jump over the alternative
+			input:             `if (true) { 10 } else { 20 }; 3333;`,
+			expectedConstants: []interface{}{10, 20, 3333},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpConstant, 0),
+				// 0003
+				code.MustMake(code.OpJump, 9),
+				// 0006
+				code.MustMake(code.OpConstant, 1),
+				// 0009
+				code.MustMake(code.OpPop),
+				// 0010
+				code.MustMake(code.OpConstant, 2),
+				// 0013
+				code.MustMake(code.OpPop),
+			},
+			optimize: true,
+		},
+		{
+			input:             `if (false) { 10 } else { 20 };`,
+			expectedConstants: []interface{}{10, 20},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpJump, 9),
+				// 0003
+				code.MustMake(code.OpConstant, 0),
+				// 0006
+				code.MustMake(code.OpJump, 12),
+				// 0009
+				code.MustMake(code.OpConstant, 1),
+				// 0012
+				code.MustMake(code.OpPop),
+			},
+			optimize: true,
+		},
+		{
+			// the inner if jumps straight to where the outer one ends
+			input:             `let c = true; if (c) { if (c) { 1 } else { 2 } } else { 3 };`,
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpTrue),
+				// 0001
+				code.MustMake(code.OpSetGlobal, 0),
+				// 0004
+				code.MustMake(code.OpGetGlobal, 0),
+				// 0007
+				code.MustMake(code.OpJumpNotTruthy, 28),
+				// 0010
+				code.MustMake(code.OpGetGlobal, 0),
+				// 0013
+				code.MustMake(code.OpJumpNotTruthy, 22),
+				// 0016
+				code.MustMake(code.OpConstant, 0),
+				// 0019
+				code.MustMake(code.OpJump, 31),
+				// 0022
+				code.MustMake(code.OpConstant, 1),
+				// 0025
+				code.MustMake(code.OpJump, 31),
+				// 0028
+				code.MustMake(code.OpConstant, 2),
+				// 0031
+				code.MustMake(code.OpPop),
+			},
+			optimize: true,
+		},
+		{
+			// the value of the last statement is kept for the REPL
+			program:           asttest.Program(asttest.While("true", asttest.Stmts("1;")...)),
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.MustMake(code.OpConstant, 0),
+				// 0003
+				code.MustMake(code.OpPop),
+				// 0004
+				code.MustMake(code.OpJump, 0),
+				// 0007
+				code.MustMake(code.OpNull),
+				// 0008
+				code.MustMake(code.OpPop),
+			},
+			optimize: true,
+		},
+		{
+			// every jump ends up on the next instruction and goes
+			program:           asttest.Program(append([]ast.Statement{asttest.While("false", asttest.Break())}, asttest.Stmts("1;")...)...),
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpPop),
+			},
+			optimize: true,
+		},
+		{
+			program:           asttest.Program(append(append(asttest.Stmts("let x = 1;"), asttest.Assign("x", "=", "2")), asttest.Stmts("let y = 3; x;")...)...),
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpConstant, 0),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpConstant, 1),
+				code.MustMake(code.OpSetGlobal, 0),
+				code.MustMake(code.OpConstant, 2),
+				code.MustMake(code.OpSetGlobal, 1),
+				code.MustMake(code.OpGetGlobal, 0),
+				code.MustMake(code.OpPop),
+			},
+			optimize: true,
+		},
+		{
+			input: `fn() { let a = 1; a; a }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.MustMake(code.OpConstant, 0),
+					code.MustMake(code.OpSetLocal, 0),
+					code.MustMake(code.OpGetLocal, 0),
+					code.MustMake(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.MustMake(code.OpClosure, 1, 0),
+				code.MustMake(code.OpPop),
+			},
+			optimize: true,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestPeepholePositions(t *testing.T) {
+	input := "let x = 1;\nx;\nx + 1"
+
+	comp := New()
+	comp.SetSource("", input)
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// the dropped statement leaves no entry, the ones behind it move up
+	expected := code.PositionTable{
+		{Offset: 0, Pos: code.Position{Line: 1, Column: 9}},
+		{Offset: 3, Pos: code.Position{Line: 1, Column: 1}},
+		{Offset: 6, Pos: code.Position{Line: 3, Column: 1}},
+		{Offset: 9, Pos: code.Position{Line: 3, Column: 5}},
+		{Offset: 12, Pos: code.Position{Line: 3, Column: 3}},
+	}
+	if err := testPositions(expected, comp.Bytecode().Positions); err != nil {
+		t.Error(err)
+	}
+}
+
+func testPositions(expected, actual code.PositionTable) error {
+	if len(actual) != len(expected) {
+		return fmt.Errorf("wrong position table length.\nwant=%v\ngot =%v", expected, actual)
+	}
+	for i, entry := range expected {
+		if actual[i] != entry {
+			return fmt.Errorf("wrong entry at %d. want=%+v, got=%+v", i, entry, actual[i])
+		}
+	}
+	return nil
+}
+
+func TestWideOperands(t *testing.T) {
+	// 300 locals, the last ones past what one operand byte holds
+	names := make([]string, 300)
+	body := ""
+	for i := range names {
+		names[i] = letterName(i)
+		body += fmt.Sprintf("let %s = %d; ", names[i], i)
+	}
+	input := fmt.Sprintf("fn() { %s%s }", body, names[len(names)-1])
+
+	comp := New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	fn, ok := bytecode.Constants[len(bytecode.Constants)-1].(*code.CompiledFunction)
+	if !ok {
+		t.Fatalf("last constant is not CompiledFunction. got=%T", bytecode.Constants[len(bytecode.Constants)-1])
+	}
+	wide, _ := code.MakeWide(code.OpGetLocal, 299)
+	tail := concatInstructions([]code.Instructions{wide, code.MustMake(code.OpReturnValue)})
+	if got := fn.Instructions[len(fn.Instructions)-len(tail):]; string(got) != string(tail) {
+		t.Errorf("wrong function tail.\nwant=%s\ngot =%s", tail, code.Instructions(got))
+	}
+}
+
+func TestFarJumps(t *testing.T) {
+	// the consequence alone is longer than a 2 byte jump reaches
+	body := ""
+	for i := 0; i < 17000; i++ {
+		body += fmt.Sprintf("%d; ", i)
+	}
+	input := fmt.Sprintf("let c = true; if (c) { %s}; 1;", body)
+
+	// the peephole pass lays the scope out again and has to keep the wide jumps
+	for _, optimize := range []bool{false, true} {
+		comp := New()
+		comp.SetSource("", input)
+		comp.SetOptimize(optimize)
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := comp.Bytecode()
+		ins := bytecode.Instructions
+
+		jump, err := code.ReadInstruction(ins, 7)
+		if err != nil {
+			t.Fatalf("optimize=%t: cannot read jump: %s", optimize, err)
+		}
+		if jump.Op != code.OpJumpNotTruthy || !jump.Wide {
+			t.Fatalf("optimize=%t: expected OpWide OpJumpNotTruthy. got=%s wide=%t", optimize, jump.Def.Name, jump.Wide)
+		}
+
+		// the alternative is the OpNull right behind the jump over it
+		target := jump.Operands[0]
+		if target <= 0xFFFF || code.Opcode(ins[target]) != code.OpNull {
+			t.Fatalf("optimize=%t: jump lands at %d, not on the alternative", optimize, target)
+		}
+		over, err := code.ReadInstruction(ins, target-6)
+		if err != nil || over.Op != code.OpJump || !over.Wide || over.Operands[0] != target+1 {
+			t.Fatalf("optimize=%t: expected OpWide OpJump %d before the alternative. got=%+v (%v)", optimize, target+1, over, err)
+		}
+
+		for _, entry := range bytecode.Positions {
+			if _, err := code.ReadInstruction(ins, entry.Offset); err != nil || entry.Offset >= len(ins) {
+				t.Fatalf("optimize=%t: position entry %+v is not on an instruction", optimize, entry)
+			}
+		}
+	}
+}
+
+// identifiers are letters only -> va, vb, ..., vz, vba, ..., the v keeps clear of fn and if
+func letterName(i int) string {
+	name := string(rune('a' + i%26))
+	for i /= 26; i > 0; i /= 26 {
+		name = string(rune('a'+i%26)) + name
+	}
+	return "v" + name
+}
@@ -0,0 +1,77 @@
+package compiler
+
+import (
+	"bytes"
+	"monkey-c/code"
+	"monkey-i/object"
+)
+
+/*
+finds the pool entry an equal constant already has -> integers and strings
+are equal by value, so every string literal of a program is one object and
+the VM can compare constants by pointer. functions have to match in every
+field, a function from another place in the source keeps its own entry
+so tracebacks and the debugger still point at the right lines
+*/
+type constantIndex struct {
+	integers  map[int64]int
+	strings   map[string]int
+	functions map[string][]int // instructions -> every function with them
+}
+
+func newConstantIndex() *constantIndex {
+	return &constantIndex{
+		integers:  map[int64]int{},
+		strings:   map[string]int{},
+		functions: map[string][]int{},
+	}
+}
+
+func (ci *constantIndex) lookup(constants []object.Object, obj object.Object) (int, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		index, ok := ci.integers[obj.Value]
+		return index, ok
+	case *object.String:
+		index, ok := ci.strings[obj.Value]
+		return index, ok
+	case *code.CompiledFunction:
+		for _, index := range ci.functions[string(obj.Instructions)] {
+			if sameFunction(constants[index].(*code.CompiledFunction), obj) {
+				return index, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (ci *constantIndex) add(obj object.Object, index int) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		ci.integers[obj.Value] = index
+	case *object.String:
+		ci.strings[obj.Value] = index
+	case *code.CompiledFunction:
+		key := string(obj.Instructions)
+		ci.functions[key] = append(ci.functions[key], index)
+	}
+}
+
+func sameFunction(a, b *code.CompiledFunction) bool {
+	if !bytes.Equal(a.Instructions, b.Instructions) || a.NumLocals != b.NumLocals ||
+		a.NumParameters != b.NumParameters || a.Name != b.Name ||
+		len(a.Positions) != len(b.Positions) || len(a.LocalNames) != len(b.LocalNames) {
+		return false
+	}
+	for i := range a.Positions {
+		if a.Positions[i] != b.Positions[i] {
+			return false
+		}
+	}
+	for i := range a.LocalNames {
+		if a.LocalNames[i] != b.LocalNames[i] {
+			return false
+		}
+	}
+	return true
+}
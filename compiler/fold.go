@@ -0,0 +1,139 @@
+package compiler
+
+import (
+	"monkey-c/code"
+	"monkey-i/ast"
+	"monkey-i/object"
+)
+
+/*
+evaluates an expression made only of integer, boolean and string literals
+at compile time -> ok is false for anything whose value the VM has to
+compute, including operations that fail at runtime (division by zero,
+negating a boolean) so they keep failing there. comparisons of strings
+and of mixed types are left to the VM as well
+*/
+func foldConstant(node ast.Expression) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}, true
+
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}, true
+
+	case *ast.Boolean:
+		return &object.Boolean{Value: node.Value}, true
+
+	case *ast.PrefixExpression:
+		right, ok := foldConstant(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldPrefix(node.Operator, right)
+
+	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return nil, false
+		}
+		left, ok := foldConstant(node.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := foldConstant(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldInfix(node.Operator, left, right)
+	}
+
+	return nil, false
+}
+
+func foldPrefix(operator string, right object.Object) (object.Object, bool) {
+	switch operator {
+	case "!":
+		// only false is falsy among constants, null never gets here
+		if b, ok := right.(*object.Boolean); ok {
+			return &object.Boolean{Value: !b.Value}, true
+		}
+		return &object.Boolean{Value: false}, true
+	case "-":
+		if i, ok := right.(*object.Integer); ok {
+			return &object.Integer{Value: -i.Value}, true
+		}
+	}
+	return nil, false
+}
+
+func foldInfix(operator string, left, right object.Object) (object.Object, bool) {
+	switch left := left.(type) {
+	case *object.Integer:
+		right, ok := right.(*object.Integer)
+		if !ok {
+			return nil, false
+		}
+		return foldIntegerInfix(operator, left.Value, right.Value)
+
+	case *object.Boolean:
+		right, ok := right.(*object.Boolean)
+		if !ok {
+			return nil, false
+		}
+		switch operator {
+		case "==":
+			return &object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return &object.Boolean{Value: left.Value != right.Value}, true
+		}
+
+	case *object.String:
+		right, ok := right.(*object.String)
+		if ok && operator == "+" {
+			return &object.String{Value: left.Value + right.Value}, true
+		}
+	}
+	return nil, false
+}
+
+func foldIntegerInfix(operator string, left, right int64) (object.Object, bool) {
+	switch operator {
+	case "+":
+		return &object.Integer{Value: left + right}, true
+	case "-":
+		return &object.Integer{Value: left - right}, true
+	case "*":
+		return &object.Integer{Value: left * right}, true
+	case "/":
+		if right == 0 {
+			return nil, false
+		}
+		return &object.Integer{Value: left / right}, true
+	case ">":
+		return &object.Boolean{Value: left > right}, true
+	case ">=":
+		return &object.Boolean{Value: left >= right}, true
+	case "<":
+		return &object.Boolean{Value: left < right}, true
+	case "<=":
+		return &object.Boolean{Value: left <= right}, true
+	case "==":
+		return &object.Boolean{Value: left == right}, true
+	case "!=":
+		return &object.Boolean{Value: left != right}, true
+	}
+	return nil, false
+}
+
+// a folded value is emitted the way its literal would be
+func (c *Compiler) emitConstant(value object.Object) {
+	switch value := value.(type) {
+	case *object.Boolean:
+		if value.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+	default:
+		c.emit(code.OpConstant, c.addConstant(value))
+	}
+}
@@ -0,0 +1,182 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey-c/code"
+)
+
+/*
+rewrites a finished scope -> jumps to a jump go straight to where the chain
+ends, and what does nothing at runtime is dropped: an OpJump to the
+instruction right behind it, OpTrue/OpFalse followed by a conditional jump
+that then always or never jumps, OpNull; OpPop, and the OpGetLocal x; OpPop
+behind an OpSetLocal x (globals alike) an assignment statement leaves.
+an instruction only goes when no jump lands on it, except for the first of
+a sequence whose jumps then land behind it. the layout afterwards moves
+jumps and positions like relaxJumps, far holds the targets of its placeholders
+*/
+func peephole(ins code.Instructions, far map[int]int, positions code.PositionTable) (code.Instructions, code.PositionTable, error) {
+	items, index, err := decodeItems(ins, far)
+	if err != nil {
+		return nil, nil, fmt.Errorf("optimizing: %s", err)
+	}
+	// shortened jumps may fit the narrow form again
+	for _, it := range items {
+		if isJump(it.in.Op) {
+			it.wide = false
+		}
+	}
+
+	p := &peepholer{items: items}
+	for p.pass() {
+	}
+
+	optimized, moved, err := layoutItems(items, index, positions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("optimizing: %s", err)
+	}
+	return optimized, moved, nil
+}
+
+type peepholer struct {
+	items    []*relaxItem
+	targeted map[int]bool // items some jump lands on
+}
+
+// the first item at or behind i still there, len(items) for the end
+func (p *peepholer) live(i int) int {
+	for i < len(p.items) && p.items[i].removed {
+		i++
+	}
+	return i
+}
+
+func (p *peepholer) next(i int) int {
+	return p.live(i + 1)
+}
+
+func (p *peepholer) is(i int, op code.Opcode) bool {
+	return i < len(p.items) && p.items[i].in.Op == op
+}
+
+// jumps landing on a removed item land on the one behind it
+func (p *peepholer) remove(i int) {
+	p.items[i].removed = true
+	if p.targeted[i] {
+		p.targeted[p.next(i)] = true
+	}
+}
+
+/*
+where a jump to i ends up after following unconditional jumps -> a chain
+running in a circle is left alone
+*/
+func (p *peepholer) destination(i int) int {
+	seen := map[int]bool{}
+	for p.is(i, code.OpJump) {
+		if seen[i] {
+			return -1
+		}
+		seen[i] = true
+		i = p.live(p.items[i].target)
+	}
+	return i
+}
+
+// one sweep over the scope, reports whether anything changed
+func (p *peepholer) pass() bool {
+	changed := false
+
+	p.targeted = map[int]bool{}
+	for i, it := range p.items {
+		if it.removed || !isJump(it.in.Op) {
+			continue
+		}
+		target := p.live(it.target)
+		if dest := p.destination(target); dest >= 0 && dest != i {
+			target = dest
+		}
+		if target != it.target {
+			it.target, changed = target, true
+		}
+		p.targeted[target] = true
+	}
+
+	for i := p.live(0); i < len(p.items); i = p.next(i) {
+		it := p.items[i]
+		j := p.next(i)
+
+		if it.in.Op == code.OpJump && p.live(it.target) == j {
+			p.remove(i)
+			changed = true
+			continue
+		}
+		if j == len(p.items) || p.targeted[j] {
+			continue
+		}
+		following := p.items[j]
+
+		switch {
+		case (it.in.Op == code.OpTrue || it.in.Op == code.OpFalse) &&
+			(following.in.Op == code.OpJumpNotTruthy || following.in.Op == code.OpJumpTruthy):
+			p.remove(i)
+			if (it.in.Op == code.OpTrue) == (following.in.Op == code.OpJumpTruthy) {
+				following.in.Op = code.OpJump
+				p.targeted[following.target] = true
+			} else {
+				p.remove(j)
+			}
+			changed = true
+
+		// the last value popped in main is what a REPL shows
+		case it.in.Op == code.OpNull && following.in.Op == code.OpPop && p.next(j) < len(p.items):
+			p.remove(i)
+			p.remove(j)
+			changed = true
+
+		case it.in.Op == code.OpSetLocal && following.in.Op == code.OpGetLocal,
+			it.in.Op == code.OpSetGlobal && following.in.Op == code.OpGetGlobal:
+			k := p.next(j)
+			if following.in.Operands[0] == it.in.Operands[0] && p.is(k, code.OpPop) && !p.targeted[k] {
+				p.remove(j)
+				p.remove(k)
+				changed = true
+			}
+		}
+	}
+
+	return changed
+}
+
+/*
+a scope is complete -> the peephole pass runs over it unless disabled,
+far jumps get their wide form either way
+*/
+func (c *Compiler) finishScope() {
+	if !c.optimize {
+		c.relaxFarJumps()
+		return
+	}
+
+	scope := &c.scopes[c.scopeIndex]
+	ins, positions, err := peephole(scope.instructions, scope.farJumps, scope.positions)
+	if err != nil {
+		if c.err == nil {
+			c.err = err
+		}
+		return
+	}
+	scope.instructions, scope.positions, scope.farJumps = ins, positions, nil
+
+	// what the last instructions are may have changed with the offsets
+	scope.lastInstruction, scope.lastToLastInstruction = EmittedInstruction{}, EmittedInstruction{}
+	for i := 0; i < len(ins); {
+		in, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			break
+		}
+		scope.lastToLastInstruction = scope.lastInstruction
+		scope.lastInstruction = EmittedInstruction{Opcode: in.Op, Position: i}
+		i += in.Size
+	}
+}
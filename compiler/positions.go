@@ -0,0 +1,213 @@
+package compiler
+
+import (
+	"monkey-c/code"
+	"monkey-i/ast"
+	"monkey-i/lexer"
+	"monkey-i/token"
+	"strings"
+)
+
+/*
+monkey-i tokens carry no location, so positions are recovered after parsing:
+the source is lexed again with every token located in the text, then the AST
+is walked in source order matching each node's token against that stream
+*/
+type sourceToken struct {
+	tok token.Token
+	pos code.Position
+}
+
+func lexPositions(file, input string) []sourceToken {
+	l := lexer.New(input)
+	tokens := []sourceToken{}
+
+	offset, scanned, line, lineStart := 0, 0, 1, 0
+	for {
+		tok := l.NextToken()
+		if tok.Type == token.EOF {
+			break
+		}
+
+		needle := tok.Literal
+		if tok.Type == token.STRING {
+			needle = `"` + tok.Literal
+		}
+
+		idx := strings.Index(input[offset:], needle)
+		if idx < 0 {
+			// lost sync with the lexer -> everything after stays unpositioned
+			break
+		}
+
+		start := offset + idx
+		for ; scanned < start; scanned++ {
+			if input[scanned] == '\n' {
+				line++
+				lineStart = scanned + 1
+			}
+		}
+
+		pos := code.Position{File: file, Line: line, Column: start - lineStart + 1}
+		tokens = append(tokens, sourceToken{tok: tok, pos: pos})
+		offset = start + len(needle)
+	}
+
+	return tokens
+}
+
+type nodeLocator struct {
+	tokens    []sourceToken
+	cursor    int
+	positions map[ast.Node]code.Position
+}
+
+func locatePositions(file, input string, program *ast.Program) map[ast.Node]code.Position {
+	l := &nodeLocator{tokens: lexPositions(file, input), positions: make(map[ast.Node]code.Position)}
+	l.walk(program)
+	return l.positions
+}
+
+/*
+node tokens are a subsequence of the token stream, so the first match past
+the cursor is the node's own token; a token that cannot be found (syntax the
+lexer here does not know) leaves the node unpositioned without losing sync
+*/
+func (l *nodeLocator) match(node ast.Node, tok token.Token) bool {
+	for i := l.cursor; i < len(l.tokens); i++ {
+		if l.tokens[i].tok.Type == tok.Type && l.tokens[i].tok.Literal == tok.Literal {
+			l.positions[node] = l.tokens[i].pos
+			l.cursor = i + 1
+			return true
+		}
+	}
+	return false
+}
+
+// hash pairs live in a map with no source order -> skip to the closing brace
+func (l *nodeLocator) skipBraces() {
+	depth := 1
+	for ; l.cursor < len(l.tokens); l.cursor++ {
+		switch l.tokens[l.cursor].tok.Type {
+		case token.LBRACE:
+			depth++
+		case token.RBRACE:
+			depth--
+		}
+
+		if depth == 0 {
+			l.cursor++
+			return
+		}
+	}
+}
+
+func (l *nodeLocator) walk(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			l.walk(s)
+		}
+
+	case *ast.LetStatement:
+		l.match(node, node.Token)
+		l.walk(node.Name)
+		l.walk(node.Value)
+
+	case *ast.ReturnStatement:
+		l.match(node, node.Token)
+		l.walk(node.ReturnValue)
+
+	case *ast.ExpressionStatement:
+		// shares its token with the expression it wraps
+		l.walk(node.Expression)
+		if pos, ok := l.positions[node.Expression]; ok {
+			l.positions[node] = pos
+		}
+
+	case *ast.BlockStatement:
+		if node == nil {
+			return
+		}
+		l.match(node, node.Token)
+		for _, s := range node.Statements {
+			l.walk(s)
+		}
+
+	case *ast.Identifier:
+		l.match(node, node.Token)
+
+	case *ast.IntegerLiteral:
+		l.match(node, node.Token)
+
+	case *ast.StringLiteral:
+		l.match(node, node.Token)
+
+	case *ast.Boolean:
+		l.match(node, node.Token)
+
+	case *ast.PrefixExpression:
+		l.match(node, node.Token)
+		l.walk(node.Right)
+
+	case *ast.InfixExpression:
+		l.walk(node.Left)
+		l.match(node, node.Token)
+		l.walk(node.Right)
+
+	case *ast.IfExpression:
+		l.match(node, node.Token)
+		l.walk(node.Condition)
+		l.walk(node.Consequence)
+		l.walk(node.Alternative)
+
+	case *ast.FunctionBlock:
+		l.match(node, node.Token)
+		for _, p := range node.Parameters {
+			l.walk(p)
+		}
+		l.walk(node.Body)
+
+	case *ast.CallExpression:
+		l.walk(node.Function)
+		l.match(node, node.Token)
+		for _, a := range node.Arguments {
+			l.walk(a)
+		}
+
+	case *ast.ArrayLiteral:
+		l.match(node, node.Token)
+		for _, el := range node.Elements {
+			l.walk(el)
+		}
+
+	case *ast.IndexExpression:
+		l.walk(node.Left)
+		l.match(node, node.Token)
+		l.walk(node.Index)
+
+	case *ast.HashLiteral:
+		if l.match(node, node.Token) {
+			l.skipBraces()
+		}
+
+	case *code.WhileStatement:
+		l.match(node, node.Token)
+		l.walk(node.Condition)
+		l.walk(node.Body)
+
+	case *code.BreakStatement:
+		l.match(node, node.Token)
+
+	case *code.ContinueStatement:
+		l.match(node, node.Token)
+
+	case *code.AssignExpression:
+		l.walk(node.Left)
+		l.match(node, node.Token)
+		l.walk(node.Right)
+
+	case *code.FloatLiteral:
+		l.match(node, node.Token)
+	}
+}
@@ -0,0 +1,144 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey-c/code"
+)
+
+type relaxItem struct {
+	offset  int
+	in      code.Instruction
+	target  int // index of the jump target, len(items) for the end
+	wide    bool
+	removed bool // dropped by the peephole pass, takes no space
+}
+
+func (it *relaxItem) size() int {
+	if it.removed {
+		return 0
+	}
+	if it.wide {
+		def, _ := code.LookupWide(byte(it.in.Op))
+		return 2 + def.OperandsLen()
+	}
+	def, _ := code.Lookup(byte(it.in.Op))
+	return 1 + def.OperandsLen()
+}
+
+/*
+re-lays out a finished scope so every jump reaches its target -> far holds
+the targets placeholders could not store, jumps that need more than two
+bytes get the wide form and everything behind them moves, so the sizes are
+recomputed until no further jump has to grow. positions follow the moves
+*/
+func relaxJumps(ins code.Instructions, far map[int]int, positions code.PositionTable) (code.Instructions, code.PositionTable, error) {
+	items, index, err := decodeItems(ins, far)
+	if err != nil {
+		return nil, nil, fmt.Errorf("relaxing jumps: %s", err)
+	}
+	relaxed, moved, err := layoutItems(items, index, positions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("relaxing jumps: %s", err)
+	}
+	return relaxed, moved, nil
+}
+
+// one item per instruction, jumps point at the index of their target
+func decodeItems(ins code.Instructions, far map[int]int) ([]*relaxItem, map[int]int, error) {
+	items := []*relaxItem{}
+	index := map[int]int{}
+	for i := 0; i < len(ins); {
+		in, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s at %04d", err, i)
+		}
+		index[i] = len(items)
+		items = append(items, &relaxItem{offset: i, in: in, wide: in.Wide})
+		i += in.Size
+	}
+	index[len(ins)] = len(items)
+
+	for _, it := range items {
+		if !isJump(it.in.Op) {
+			continue
+		}
+
+		target := it.in.Operands[0]
+		if t, ok := far[it.offset]; ok {
+			target = t
+		}
+		i, ok := index[target]
+		if !ok {
+			return nil, nil, fmt.Errorf("target %04d of jump at %04d is not an instruction", target, it.offset)
+		}
+		it.target = i
+	}
+	return items, index, nil
+}
+
+/*
+encodes the items at their new offsets -> index maps the old offsets to
+items for moving the positions. a removed item sits where the next one
+starts, so jumps and positions pointing at it end up there
+*/
+func layoutItems(items []*relaxItem, index map[int]int, positions code.PositionTable) (code.Instructions, code.PositionTable, error) {
+	newOffsets := make([]int, len(items)+1)
+	for changed := true; changed; {
+		offset := 0
+		for i, it := range items {
+			newOffsets[i] = offset
+			offset += it.size()
+		}
+		newOffsets[len(items)] = offset
+
+		changed = false
+		for _, it := range items {
+			if isJump(it.in.Op) && !it.removed && !it.wide && !code.Fits(newOffsets[it.target], 2) {
+				it.wide, changed = true, true
+			}
+		}
+	}
+
+	relaxed := code.Instructions{}
+	for _, it := range items {
+		if it.removed {
+			continue
+		}
+
+		operands := append([]int{}, it.in.Operands...)
+		if isJump(it.in.Op) {
+			operands[0] = newOffsets[it.target]
+		}
+
+		make := code.Make
+		if it.wide {
+			make = code.MakeWide
+		}
+		encoded, err := make(it.in.Op, operands...)
+		if err != nil {
+			return nil, nil, err
+		}
+		relaxed = append(relaxed, encoded...)
+	}
+
+	moved := code.PositionTable{}
+	for _, entry := range positions {
+		if j, ok := index[entry.Offset]; ok {
+			entry.Offset = newOffsets[j]
+		}
+		// the entry of a removed instruction gives way to the one of the instruction now in its place
+		if n := len(moved); n > 0 && moved[n-1].Offset == entry.Offset {
+			moved = moved[:n-1]
+		}
+		if n := len(moved); n > 0 && moved[n-1].Pos == entry.Pos {
+			continue
+		}
+		moved = append(moved, entry)
+	}
+
+	return relaxed, moved, nil
+}
+
+func isJump(op code.Opcode) bool {
+	return op == code.OpJump || op == code.OpJumpNotTruthy || op == code.OpJumpTruthy
+}
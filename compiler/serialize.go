@@ -0,0 +1,353 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"monkey-c/code"
+	"monkey-i/object"
+)
+
+/*
+on-disk layout of a .monkeyc artifact, every length and count is a uvarint:
+
+	magic "MNKC" | version uint16 | main instructions | main positions |
+	constant count | constants...
+
+a constant is a tag byte followed by its payload, functions carry their
+own instructions and position table so runtime errors keep their locations,
+and the names of their locals for the debugger
+*/
+const (
+	BytecodeMagic   = "MNKC"
+	BytecodeVersion = 1
+)
+
+const (
+	tagInteger byte = iota + 1
+	tagString
+	tagFloat
+	tagFunction
+)
+
+var ErrInvalidBytecode = errors.New("invalid bytecode")
+
+func invalidf(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidBytecode, fmt.Sprintf(format, a...))
+}
+
+func (b *Bytecode) Encode(w io.Writer) error {
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func Decode(r io.Reader) (*Bytecode, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bytecode{}
+	if err := b.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Bytecode) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(BytecodeMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(BytecodeVersion))
+
+	writeBytes(&buf, b.Instructions)
+	writePositions(&buf, b.Positions)
+
+	writeUvarint(&buf, uint64(len(b.Constants)))
+	for i, constant := range b.Constants {
+		if err := writeConstant(&buf, constant); err != nil {
+			return nil, fmt.Errorf("constant %d: %w", i, err)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (b *Bytecode) UnmarshalBinary(data []byte) error {
+	r := &byteReader{data: data}
+
+	if magic := string(r.next(len(BytecodeMagic))); magic != BytecodeMagic {
+		return invalidf("bad magic %q", magic)
+	}
+	if version := binary.BigEndian.Uint16(r.next(2)); r.err == nil && version != BytecodeVersion {
+		return invalidf("unsupported format version %d, want %d", version, BytecodeVersion)
+	}
+
+	instructions := code.Instructions(r.bytes())
+	positions := r.positions()
+
+	constants := make([]object.Object, r.count())
+	for i := range constants {
+		if r.err != nil {
+			break
+		}
+		constants[i] = r.constant()
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	if r.offset != len(data) {
+		return invalidf("%d trailing bytes", len(data)-r.offset)
+	}
+
+	if err := validateInstructions(instructions, constants); err != nil {
+		return fmt.Errorf("main: %w", err)
+	}
+	for i, constant := range constants {
+		if fn, ok := constant.(*code.CompiledFunction); ok {
+			if err := validateInstructions(fn.Instructions, constants); err != nil {
+				return fmt.Errorf("constant %d: %w", i, err)
+			}
+		}
+	}
+
+	b.Instructions = instructions
+	b.Positions = positions
+	b.Constants = constants
+	return nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func writeVarint(buf *bytes.Buffer, v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutVarint(tmp[:], v)])
+}
+
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	writeUvarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func writePositions(buf *bytes.Buffer, positions code.PositionTable) {
+	writeUvarint(buf, uint64(len(positions)))
+	for _, entry := range positions {
+		writeUvarint(buf, uint64(entry.Offset))
+		writeBytes(buf, []byte(entry.Pos.File))
+		writeUvarint(buf, uint64(entry.Pos.Line))
+		writeUvarint(buf, uint64(entry.Pos.Column))
+	}
+}
+
+func writeConstant(buf *bytes.Buffer, constant object.Object) error {
+	switch constant := constant.(type) {
+	case *object.Integer:
+		buf.WriteByte(tagInteger)
+		writeVarint(buf, constant.Value)
+
+	case *object.String:
+		buf.WriteByte(tagString)
+		writeBytes(buf, []byte(constant.Value))
+
+	case *code.Float:
+		buf.WriteByte(tagFloat)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(constant.Value))
+
+	case *code.CompiledFunction:
+		buf.WriteByte(tagFunction)
+		writeBytes(buf, constant.Instructions)
+		writeUvarint(buf, uint64(constant.NumLocals))
+		writeUvarint(buf, uint64(constant.NumParameters))
+		writeBytes(buf, []byte(constant.Name))
+		writePositions(buf, constant.Positions)
+		writeUvarint(buf, uint64(len(constant.LocalNames)))
+		for _, name := range constant.LocalNames {
+			writeBytes(buf, []byte(name))
+		}
+
+	default:
+		return fmt.Errorf("cannot serialize constant of type %T", constant)
+	}
+	return nil
+}
+
+/*
+reads from an in-memory artifact -> the first failure sticks in err and
+every later read returns zero values, so callers check err once at the end
+*/
+type byteReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (r *byteReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *byteReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data)-r.offset {
+		r.fail(invalidf("unexpected end of data at byte %d", r.offset))
+		return make([]byte, max(n, 0))
+	}
+	b := r.data[r.offset : r.offset+n]
+	r.offset += n
+	return b
+}
+
+func (r *byteReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.offset:])
+	if n <= 0 {
+		r.fail(invalidf("malformed varint at byte %d", r.offset))
+		return 0
+	}
+	r.offset += n
+	return v
+}
+
+func (r *byteReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data[r.offset:])
+	if n <= 0 {
+		r.fail(invalidf("malformed varint at byte %d", r.offset))
+		return 0
+	}
+	r.offset += n
+	return v
+}
+
+// a value that must fit an int and can never exceed the bytes left to read
+func (r *byteReader) count() int {
+	v := r.uvarint()
+	if v > uint64(len(r.data)-r.offset) {
+		r.fail(invalidf("length %d exceeds remaining %d bytes", v, len(r.data)-r.offset))
+		return 0
+	}
+	return int(v)
+}
+
+func (r *byteReader) int() int {
+	v := r.uvarint()
+	if v > math.MaxInt32 {
+		r.fail(invalidf("value %d out of range", v))
+		return 0
+	}
+	return int(v)
+}
+
+func (r *byteReader) bytes() []byte {
+	b := r.next(r.count())
+	return append([]byte{}, b...)
+}
+
+func (r *byteReader) positions() code.PositionTable {
+	n := r.count()
+	if n == 0 {
+		return nil
+	}
+
+	positions := make(code.PositionTable, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		entry := code.PositionEntry{Offset: r.int()}
+		entry.Pos.File = string(r.bytes())
+		entry.Pos.Line = r.int()
+		entry.Pos.Column = r.int()
+
+		if i > 0 && entry.Offset <= positions[i-1].Offset {
+			r.fail(invalidf("position offsets out of order at entry %d", i))
+		}
+		positions = append(positions, entry)
+	}
+	return positions
+}
+
+func (r *byteReader) names() []string {
+	n := r.count()
+	if n == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		names = append(names, string(r.bytes()))
+	}
+	return names
+}
+
+func (r *byteReader) constant() object.Object {
+	tag := r.next(1)[0]
+	switch tag {
+	case tagInteger:
+		return &object.Integer{Value: r.varint()}
+
+	case tagString:
+		return &object.String{Value: string(r.bytes())}
+
+	case tagFloat:
+		return &code.Float{Value: math.Float64frombits(binary.BigEndian.Uint64(r.next(8)))}
+
+	case tagFunction:
+		fn := &code.CompiledFunction{Instructions: r.bytes()}
+		fn.NumLocals = r.int()
+		fn.NumParameters = r.int()
+		fn.Name = string(r.bytes())
+		fn.Positions = r.positions()
+		fn.LocalNames = r.names()
+		if len(fn.LocalNames) > fn.NumLocals {
+			r.fail(invalidf("function %q names %d locals but has %d", fn.Name, len(fn.LocalNames), fn.NumLocals))
+		}
+
+		if fn.NumParameters > fn.NumLocals {
+			r.fail(invalidf("function %q has %d parameters but only %d locals", fn.Name, fn.NumParameters, fn.NumLocals))
+		}
+		return fn
+
+	default:
+		r.fail(invalidf("unknown constant tag %d", tag))
+		return nil
+	}
+}
+
+/*
+the stream must decode into whole instructions of known opcodes and every
+constant reference must land inside the pool, OpClosure on a function
+*/
+func validateInstructions(ins code.Instructions, constants []object.Object) error {
+	for i := 0; i < len(ins); {
+		in, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			return invalidf("%s at %04d", err, i)
+		}
+
+		operands := in.Operands
+		switch in.Op {
+		case code.OpConstant, code.OpClosure:
+			if operands[0] >= len(constants) {
+				return invalidf("%s at %04d references constant %d of %d", in.Def.Name, i, operands[0], len(constants))
+			}
+			if _, ok := constants[operands[0]].(*code.CompiledFunction); in.Op == code.OpClosure && !ok {
+				return invalidf("OpClosure at %04d references %T, not a function", i, constants[operands[0]])
+			}
+		}
+
+		i += in.Size
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package compiler
+
+import (
+	"bytes"
+	"errors"
+	"monkey-c/code"
+	"monkey-i/object"
+	"reflect"
+	"testing"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	input := `let greet = fn(name) { "hello " + name };
+let add = fn(a) { fn(b) { a + b } };
+greet("monkey");
+add(-7)(2);`
+
+	comp := New()
+	comp.SetSource("round.mk", input)
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+	bytecode.Constants = append(bytecode.Constants, &code.Float{Value: 2.5})
+
+	var buf bytes.Buffer
+	if err := bytecode.Encode(&buf); err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte(BytecodeMagic)) {
+		t.Fatalf("encoded bytecode does not start with the magic header")
+	}
+
+	decoded, err := Decode(&buf)
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	if !reflect.DeepEqual(decoded, bytecode) {
+		t.Errorf("decoded bytecode differs.\nwant=%#v\ngot =%#v", bytecode, decoded)
+	}
+}
+
+func TestBytecodeEncodeUnsupportedConstant(t *testing.T) {
+	bytecode := &Bytecode{Constants: []object.Object{&object.Boolean{Value: true}}}
+	if _, err := bytecode.MarshalBinary(); err == nil {
+		t.Fatalf("expected encode error but resulted in none.")
+	}
+}
+
+func TestBytecodeDecodeValidation(t *testing.T) {
+	valid, err := (&Bytecode{
+		Instructions: concatInstructions([]code.Instructions{
+			code.MustMake(code.OpConstant, 0),
+			code.MustMake(code.OpPop),
+		}),
+		Constants: []object.Object{&object.Integer{Value: 1}},
+	}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	encode := func(b *Bytecode) []byte {
+		data, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatalf("encode error: %s", err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"bad magic", append([]byte("MNKX"), valid[4:]...)},
+		{"unsupported version", append([]byte("MNKC\x00\x09"), valid[6:]...)},
+		{"truncated", valid[:len(valid)-1]},
+		{"trailing bytes", append(append([]byte{}, valid...), 0)},
+		{"unknown constant tag", append(append([]byte{}, valid[:len(valid)-2]...), 0x7f, 0x02)},
+		{"unknown opcode", encode(&Bytecode{Instructions: code.Instructions{0xff}})},
+		{"truncated operand", encode(&Bytecode{Instructions: code.MustMake(code.OpConstant, 0)[:2]})},
+		{"constant out of range", encode(&Bytecode{Instructions: code.MustMake(code.OpConstant, 3)})},
+		{
+			"closure over non-function",
+			encode(&Bytecode{
+				Instructions: code.MustMake(code.OpClosure, 0, 0),
+				Constants:    []object.Object{&object.String{Value: "fn"}},
+			}),
+		},
+		{
+			"invalid function body",
+			encode(&Bytecode{Constants: []object.Object{
+				&code.CompiledFunction{Instructions: code.MustMake(code.OpGetGlobal, 1)[:1]},
+			}}),
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := Decode(bytes.NewReader(tt.data))
+		if err == nil {
+			t.Errorf("%s: expected decode error but resulted in none.", tt.name)
+			continue
+		}
+		if !errors.Is(err, ErrInvalidBytecode) {
+			t.Errorf("%s: error does not wrap ErrInvalidBytecode. got=%v", tt.name, err)
+		}
+	}
+}
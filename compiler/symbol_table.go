@@ -7,6 +7,7 @@ const (
 	LocalScope    SymbolScope = "L"
 	FreeScope     SymbolScope = "F"
 	FunctionScope SymbolScope = "FN"
+	BuiltinScope  SymbolScope = "B"
 )
 
 type Symbol struct {
@@ -16,18 +17,20 @@ type Symbol struct {
 }
 
 type SymbolTable struct {
-	Outer       *SymbolTable
-	FreeSymbols []Symbol
-	store       map[string]Symbol
-	numDefs     int
+	Outer          *SymbolTable
+	FreeSymbols    []Symbol
+	CapturedLocals map[int]bool
+	store          map[string]Symbol
+	numDefs        int
+	names          []string // by index of the slot Define gave out
 }
 
 func NewSymbolTable() *SymbolTable {
-	return &SymbolTable{store: make(map[string]Symbol), FreeSymbols: []Symbol{}}
+	return &SymbolTable{store: make(map[string]Symbol), FreeSymbols: []Symbol{}, CapturedLocals: make(map[int]bool)}
 }
 
 func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
-	return &SymbolTable{store: make(map[string]Symbol), Outer: outer}
+	return &SymbolTable{store: make(map[string]Symbol), Outer: outer, CapturedLocals: make(map[int]bool)}
 }
 
 func (symt *SymbolTable) Define(val string) Symbol {
@@ -39,16 +42,36 @@ func (symt *SymbolTable) Define(val string) Symbol {
 	}
 	symt.store[val] = symbol
 	symt.numDefs++
+	symt.names = append(symt.names, val)
 	return symbol
 }
 
+// source name of every slot defined so far, a name defined twice holds two slots
+func (s *SymbolTable) Names() []string {
+	return append([]string{}, s.names...)
+}
+
 func (s *SymbolTable) DefineFunctionName(name string) Symbol {
 	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
 	s.store[name] = symbol
 	return symbol
 }
 
+func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+/*
+original always comes from s.Outer -> when it is one of the outer
+function's locals, that slot escapes and has to live in a cell
+*/
 func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	if original.Scope == LocalScope {
+		s.Outer.CapturedLocals[original.Index] = true
+	}
+
 	s.FreeSymbols = append(s.FreeSymbols, original)
 	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1, Scope: FreeScope}
 	s.store[original.Name] = symbol
@@ -60,7 +83,7 @@ func (symt *SymbolTable) Resolve(val string) (Symbol, bool) {
 	if !ok && symt.Outer != nil {
 		obj, ok = symt.Outer.Resolve(val)
 
-		if !ok || obj.Scope == GlobalScope {
+		if !ok || obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
 			return obj, ok
 		}
 
@@ -236,3 +236,64 @@ func TestShadowingFunctionName(t *testing.T) {
 		t.Errorf("expected %s to resolve to %+v, got=%+v", expected.Name, expected, result)
 	}
 }
+
+func TestDefineResolveBuiltins(t *testing.T) {
+	global := NewSymbolTable()
+	firstLocal := NewEnclosedSymbolTable(global)
+	secondLocal := NewEnclosedSymbolTable(firstLocal)
+
+	expected := []Symbol{
+		{Name: "a", Scope: BuiltinScope, Index: 0},
+		{Name: "c", Scope: BuiltinScope, Index: 1},
+		{Name: "e", Scope: BuiltinScope, Index: 2},
+		{Name: "f", Scope: BuiltinScope, Index: 3},
+	}
+
+	for i, v := range expected {
+		global.DefineBuiltin(i, v.Name)
+	}
+
+	for _, table := range []*SymbolTable{global, firstLocal, secondLocal} {
+		for _, sym := range expected {
+			result, ok := table.Resolve(sym.Name)
+			if !ok {
+				t.Errorf("name %s not resolvable", sym.Name)
+				continue
+			}
+			if result != sym {
+				t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+			}
+		}
+
+		if len(table.FreeSymbols) != 0 {
+			t.Errorf("builtins should never be captured as free. got=%+v", table.FreeSymbols)
+		}
+	}
+}
+
+func TestCapturedLocals(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	firstLocal := NewEnclosedSymbolTable(global)
+	firstLocal.Define("b")
+	firstLocal.Define("c")
+	secondLocal := NewEnclosedSymbolTable(firstLocal)
+	thirdLocal := NewEnclosedSymbolTable(secondLocal)
+
+	for _, name := range []string{"a", "c"} {
+		if _, ok := thirdLocal.Resolve(name); !ok {
+			t.Fatalf("name %s not resolvable", name)
+		}
+	}
+
+	if len(global.CapturedLocals) != 0 {
+		t.Errorf("globals should never be captured. got=%v", global.CapturedLocals)
+	}
+	if len(firstLocal.CapturedLocals) != 1 || !firstLocal.CapturedLocals[1] {
+		t.Errorf("expected only local 1 to be captured. got=%v", firstLocal.CapturedLocals)
+	}
+	// secondLocal only passes the cell on as a free symbol
+	if len(secondLocal.CapturedLocals) != 0 {
+		t.Errorf("free symbols should not be marked as captured locals. got=%v", secondLocal.CapturedLocals)
+	}
+}
@@ -0,0 +1,359 @@
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"monkey-c/code"
+	"monkey-c/compiler"
+	"monkey-c/vm"
+	"monkey-i/object"
+	"strconv"
+	"strings"
+)
+
+const prompt = "(mdb) "
+
+const help = `commands:
+  break [line|function]   set a breakpoint, without argument list them
+  delete <n>              remove breakpoint n
+  continue                run to the next breakpoint or the end
+  step                    run to the next line, entering calls
+  next                    run to the next line, stepping over calls
+  out                     run until the current function returns
+  locals                  print the locals of the current function
+  globals                 print every global
+  print <name>            print one local or global
+  stack                   print the operand stack, bottom first
+  where                   print the active frames
+  list                    print the source around the current line
+  quit                    end the session
+`
+
+// a line breakpoint has Line set, a function breakpoint Function
+type Breakpoint struct {
+	Line     int
+	Function string
+}
+
+func (b Breakpoint) String() string {
+	if b.Function != "" {
+		return "function " + b.Function
+	}
+	return "line " + strconv.Itoa(b.Line)
+}
+
+/*
+a source level debugger on top of the VM's Step/RunUntil -> the program
+pauses before its first instruction and after every command, lines come
+from the position tables and variable names from the local name tables
+of the compiled functions
+*/
+type Debugger struct {
+	vm          *vm.VM
+	globalNames []string
+	lines       []string
+	breakpoints []Breakpoint
+	out         io.Writer
+
+	finished bool
+	hit      int // breakpoint the last run stopped at, -1 for none
+
+	// line last seen in each active frame -> a line breakpoint fires when a
+	// frame moves onto its line, not when a call returns to it
+	frameLines []int
+}
+
+func New(bytecode *compiler.Bytecode, globalNames []string, source string) *Debugger {
+	d := &Debugger{
+		globalNames: globalNames,
+		lines:       strings.Split(source, "\n"),
+		hit:         -1,
+	}
+	config := vm.DefaultConfig()
+	config.Stdout = programOutput{d}
+	d.vm = vm.New(bytecode, config)
+	_, line := d.location()
+	d.frameLines = []int{line}
+	return d
+}
+
+// what the program puts is interleaved with the session on the writer Run got
+type programOutput struct{ d *Debugger }
+
+func (p programOutput) Write(b []byte) (int, error) { return p.d.out.Write(b) }
+
+// reads commands from in until quit or the input ends
+func (d *Debugger) Run(in io.Reader, out io.Writer) {
+	d.out = out
+	scanner := bufio.NewScanner(in)
+
+	d.printLocation()
+	for {
+		io.WriteString(out, prompt)
+		if !scanner.Scan() {
+			return
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "q" {
+			return
+		}
+		d.execute(fields[0], fields[1:])
+	}
+}
+
+func (d *Debugger) execute(cmd string, args []string) {
+	switch cmd {
+	case "break", "b":
+		d.cmdBreak(args)
+	case "delete", "d":
+		d.cmdDelete(args)
+	case "continue", "c":
+		d.resume(func(depth, line int) bool { return false })
+	case "step", "s":
+		startDepth, startLine := d.location()
+		d.resume(func(depth, line int) bool { return depth != startDepth || line != startLine })
+	case "next", "n":
+		startDepth, startLine := d.location()
+		d.resume(func(depth, line int) bool { return depth < startDepth || depth == startDepth && line != startLine })
+	case "out", "o":
+		startDepth, _ := d.location()
+		d.resume(func(depth, line int) bool { return depth < startDepth })
+	case "locals":
+		d.printLocals()
+	case "globals":
+		for i, name := range d.globalNames {
+			fmt.Fprintf(d.out, "%s = %s\n", name, inspect(d.vm.Globals()[i]))
+		}
+	case "print", "p":
+		d.cmdPrint(args)
+	case "stack":
+		for i, value := range d.vm.Stack() {
+			fmt.Fprintf(d.out, "%4d  %s\n", i, inspect(value))
+		}
+	case "where", "bt":
+		d.printWhere()
+	case "list", "l":
+		d.printSource()
+	case "help", "h":
+		io.WriteString(d.out, help)
+	default:
+		fmt.Fprintf(d.out, "unknown command %q, try help\n", cmd)
+	}
+}
+
+func (d *Debugger) cmdBreak(args []string) {
+	if len(args) == 0 {
+		for i, b := range d.breakpoints {
+			fmt.Fprintf(d.out, "%d: %s\n", i+1, b)
+		}
+		return
+	}
+
+	b := Breakpoint{Function: args[0]}
+	if line, err := strconv.Atoi(args[0]); err == nil {
+		if line < 1 || line > len(d.lines) {
+			fmt.Fprintf(d.out, "no line %d, the script has %d\n", line, len(d.lines))
+			return
+		}
+		b = Breakpoint{Line: line}
+	}
+	d.breakpoints = append(d.breakpoints, b)
+	fmt.Fprintf(d.out, "breakpoint %d at %s\n", len(d.breakpoints), b)
+}
+
+func (d *Debugger) cmdDelete(args []string) {
+	n, err := 0, fmt.Errorf("delete wants a breakpoint number")
+	if len(args) == 1 {
+		n, err = strconv.Atoi(args[0])
+	}
+	if err != nil || n < 1 || n > len(d.breakpoints) {
+		fmt.Fprintf(d.out, "no such breakpoint\n")
+		return
+	}
+	d.breakpoints = append(d.breakpoints[:n-1], d.breakpoints[n:]...)
+}
+
+func (d *Debugger) cmdPrint(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(d.out, "print wants a variable name\n")
+		return
+	}
+
+	if value, ok := d.lookup(args[0]); ok {
+		fmt.Fprintf(d.out, "%s = %s\n", args[0], inspect(value))
+		return
+	}
+	fmt.Fprintf(d.out, "no variable %s here\n", args[0])
+}
+
+/*
+runs until done holds for the next instruction or a breakpoint is reached,
+instructions without a position never stop a step
+*/
+func (d *Debugger) resume(done func(depth, line int) bool) {
+	if d.finished {
+		fmt.Fprintf(d.out, "the program has finished\n")
+		return
+	}
+
+	d.hit = -1
+	stopped, err := d.vm.RunUntil(func(*vm.VM) bool {
+		depth, line := d.location()
+		called := depth > len(d.frameLines)
+		entered := d.enter(depth, line)
+
+		if d.hit = d.breakpointAt(line, called, entered); d.hit >= 0 {
+			return true
+		}
+		return line > 0 && done(depth, line)
+	})
+
+	switch {
+	case err != nil:
+		d.finished = true
+		fmt.Fprintf(d.out, "runtime error: %s\n", err)
+		if rtErr, ok := err.(*vm.RuntimeError); ok {
+			io.WriteString(d.out, rtErr.Traceback.String())
+		}
+	case !stopped:
+		d.finished = true
+		fmt.Fprintf(d.out, "program finished\n")
+	default:
+		d.printLocation()
+	}
+}
+
+func (d *Debugger) enter(depth, line int) bool {
+	if depth > len(d.frameLines) {
+		d.frameLines = append(d.frameLines, line)
+		return true
+	}
+
+	d.frameLines = d.frameLines[:depth]
+	entered := d.frameLines[depth-1] != line
+	d.frameLines[depth-1] = line
+	return entered
+}
+
+/*
+a function breakpoint fires when a call pushes the function's frame, not
+whenever its first instruction comes up again as the target of a loop
+*/
+func (d *Debugger) breakpointAt(line int, called, entered bool) int {
+	record := d.vm.CurrentRecord()
+	for i, b := range d.breakpoints {
+		if b.Function != "" && called && record.Function().Name == b.Function {
+			return i
+		}
+		if b.Line != 0 && entered && b.Line == line {
+			return i
+		}
+	}
+	return -1
+}
+
+// frame depth and source line of the next instruction, line 0 when it has no position
+func (d *Debugger) location() (int, int) {
+	record := d.vm.CurrentRecord()
+	pos, _ := record.Function().Positions.Lookup(record.IP())
+	return d.vm.Depth(), pos.Line
+}
+
+func (d *Debugger) printLocation() {
+	record := d.vm.CurrentRecord()
+	pos, _ := record.Function().Positions.Lookup(record.IP())
+
+	if d.hit >= 0 {
+		fmt.Fprintf(d.out, "breakpoint %d, ", d.hit+1)
+	}
+	fmt.Fprintf(d.out, "stopped in %s at %04d", record.FunctionName(), record.IP())
+	if pos.IsValid() {
+		fmt.Fprintf(d.out, " (%s)\n%s", pos, d.sourceLine(pos.Line, true))
+		return
+	}
+	io.WriteString(d.out, "\n")
+}
+
+func (d *Debugger) sourceLine(line int, current bool) string {
+	if line < 1 || line > len(d.lines) {
+		return ""
+	}
+	marker := "  "
+	if current {
+		marker = "=>"
+	}
+	return fmt.Sprintf("%s %4d | %s\n", marker, line, d.lines[line-1])
+}
+
+func (d *Debugger) printSource() {
+	_, current := d.location()
+	if current == 0 {
+		fmt.Fprintf(d.out, "no source position here\n")
+		return
+	}
+	for line := current - 2; line <= current+2; line++ {
+		io.WriteString(d.out, d.sourceLine(line, line == current))
+	}
+}
+
+func (d *Debugger) printLocals() {
+	record := d.vm.CurrentRecord()
+	if d.vm.Depth() == 1 {
+		fmt.Fprintf(d.out, "main has no locals, try globals\n")
+		return
+	}
+
+	stack := d.vm.Stack()
+	for i, name := range record.Function().LocalNames {
+		fmt.Fprintf(d.out, "%s = %s\n", name, inspect(stack[record.BasePointer()+i]))
+	}
+}
+
+// the innermost frame is shown at its next instruction, callers at their OpCall
+func (d *Debugger) printWhere() {
+	frames := d.vm.Traceback()
+	record := d.vm.CurrentRecord()
+	innermost := &frames[len(frames)-1]
+	innermost.Offset = record.IP()
+	innermost.Pos, _ = record.Function().Positions.Lookup(record.IP())
+
+	for i := len(frames) - 1; i >= 0; i-- {
+		fmt.Fprintf(d.out, "#%d %s\n", len(frames)-1-i, frames[i])
+	}
+}
+
+// a local of the current function shadows a global, later definitions earlier ones
+func (d *Debugger) lookup(name string) (object.Object, bool) {
+	if d.vm.Depth() > 1 {
+		record := d.vm.CurrentRecord()
+		names := record.Function().LocalNames
+		for i := len(names) - 1; i >= 0; i-- {
+			if names[i] == name {
+				return d.vm.Stack()[record.BasePointer()+i], true
+			}
+		}
+	}
+
+	for i := len(d.globalNames) - 1; i >= 0; i-- {
+		if d.globalNames[i] == name {
+			return d.vm.Globals()[i], true
+		}
+	}
+	return nil, false
+}
+
+// slots not assigned yet are nil, captured ones hold a cell
+func inspect(value object.Object) string {
+	if cell, ok := value.(*code.Cell); ok {
+		value = cell.Value
+	}
+	if value == nil {
+		return "<unset>"
+	}
+	return value.Inspect()
+}
@@ -0,0 +1,120 @@
+package debugger
+
+import (
+	"monkey-c/compiler"
+	"monkey-c/internal/asttest"
+	"monkey-i/ast"
+	"monkey-i/lexer"
+	"monkey-i/parser"
+	"strings"
+	"testing"
+)
+
+const script = `let total = 0;
+let add = fn(a, b) {
+  let sum = a + b;
+  sum
+};
+let x = add(1, 2);
+let y = add(x, 10);
+y;`
+
+func session(t *testing.T, commands ...string) string {
+	t.Helper()
+	return programSession(t, "add.mk", script, parser.New(lexer.New(script)).ParseProgram(), commands...)
+}
+
+func programSession(t *testing.T, file, src string, program *ast.Program, commands ...string) string {
+	t.Helper()
+
+	comp := compiler.New()
+	comp.SetSource(file, src)
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out strings.Builder
+	New(comp.Bytecode(), comp.GlobalNames(), src).Run(strings.NewReader(strings.Join(commands, "\n")), &out)
+	return out.String()
+}
+
+func TestSession(t *testing.T) {
+	tests := []struct {
+		commands []string
+		expected []string
+	}{
+		{
+			[]string{"break add", "continue", "locals", "next", "print sum", "where"},
+			[]string{
+				"breakpoint 1, stopped in add at 0000 (add.mk:3:13)",
+				"a = 1\nb = 2\nsum = <unset>\n",
+				"stopped in add at 0007 (add.mk:4:3)\n=>    4 |   sum",
+				"sum = 3\n",
+				"#0 add at 0007 (add.mk:4:3)\n#1 <main> at 0022 (add.mk:6:12)\n",
+			},
+		},
+		{
+			// stepping over both calls, the line breakpoint fires once
+			[]string{"break 7", "next", "next", "next", "next", "globals", "next"},
+			[]string{
+				"stopped in <main> at 0006 (add.mk:2:11)",
+				"stopped in <main> at 0013 (add.mk:6:9)",
+				"breakpoint 1, stopped in <main> at 0027 (add.mk:7:9)",
+				"stopped in <main> at 0041 (add.mk:8:1)",
+				"total = 0\nadd = Closure",
+				"x = 3\ny = 13\n",
+				"program finished",
+			},
+		},
+		{
+			[]string{"break 3", "continue", "step", "step", "continue", "out", "stack", "continue"},
+			[]string{
+				"breakpoint 1, stopped in add at 0000 (add.mk:3:13)",
+				"stopped in add at 0007 (add.mk:4:3)",
+				"stopped in <main> at 0024 (add.mk:6:1)",
+				"breakpoint 1, stopped in add at 0000 (add.mk:3:13)",
+				"stopped in <main> at 0038 (add.mk:7:1)",
+				"   0  13\n",
+				"program finished",
+			},
+		},
+		{
+			[]string{"break 42", "break", "delete 3", "print nothing", "frobnicate", "continue", "continue"},
+			[]string{
+				"no line 42, the script has 8",
+				"no such breakpoint",
+				"no variable nothing here",
+				`unknown command "frobnicate"`,
+				"program finished",
+				"the program has finished",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		out := session(t, tt.commands...)
+
+		// every expectation in order
+		rest := out
+		for _, want := range tt.expected {
+			i := strings.Index(rest, want)
+			if i < 0 {
+				t.Fatalf("%v: missing %q in\n%s", tt.commands, want, out)
+			}
+			rest = rest[i+len(want):]
+		}
+	}
+}
+
+func TestFunctionBreakpointOnLoopHeadedFunction(t *testing.T) {
+	src := "let spin = fn(n) { n };\nspin(3);"
+	program := parser.New(lexer.New(src)).ParseProgram()
+	// let spin = fn(n) { while (n > 0) { n -= 1; }; n }; the loop jumps back to offset 0
+	spin := program.Statements[0].(*ast.LetStatement).Value.(*ast.FunctionBlock)
+	spin.Body = asttest.Block(asttest.While("n > 0", asttest.Assign("n", "-=", "1")), asttest.ExprStmt(asttest.Expr("n")))
+
+	out := programSession(t, "spin.mk", src, program, "break spin", "continue", "continue")
+	if strings.Count(out, "breakpoint 1, stopped in spin") != 1 || !strings.Contains(out, "program finished") {
+		t.Errorf("the breakpoint should fire once per call.\n%s", out)
+	}
+}
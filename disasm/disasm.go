@@ -0,0 +1,244 @@
+package disasm
+
+import (
+	"fmt"
+	"io"
+	"monkey-c/code"
+	"monkey-c/compiler"
+	"monkey-i/object"
+	"strconv"
+	"strings"
+)
+
+/*
+listing layout, one directive or instruction per line:
+
+	.const 0 int 5
+	.const 1 string "hi"
+
+	.func main
+	.pos "add.mk" 1 1
+	0000  OpConstant 0                  ; 5
+	0003  OpJumpNotTruthy L0009
+	L0009:
+	.pos "add.mk" 2 3
+	0009  OpNull
+	0010  OpWide OpConstant 70000       ; 1
+
+	.func 2 "add" params=2 locals=2
+	.locals "a" "b"
+	...
+
+every constant is listed before the sections, functions get their own
+.func section in pool order and jump operands are printed as the label
+of their target. a .pos line starts the run of instructions at one
+source position and .locals names the local slots in order, so the
+listing holds all the bytecode is made of, debug info included
+*/
+
+const commentColumn = 36
+
+var jumpOps = map[code.Opcode]bool{
+	code.OpJump:          true,
+	code.OpJumpNotTruthy: true,
+	code.OpJumpTruthy:    true,
+}
+
+func IsJump(op code.Opcode) bool { return jumpOps[op] }
+
+type Instruction struct {
+	Offset int
+	code.Instruction
+}
+
+// a stream that cannot be split into instructions, Offset is where it breaks
+type DecodeError struct {
+	Offset  int
+	Message string
+}
+
+func (e *DecodeError) Error() string { return fmt.Sprintf("%04d: %s", e.Offset, e.Message) }
+
+func Label(offset int) string { return fmt.Sprintf("L%04d", offset) }
+
+/*
+splits a stream into whole instructions -> unknown opcodes and operands
+running past the end are reported instead of guessed at
+*/
+func Decode(ins code.Instructions) ([]Instruction, error) {
+	decoded := []Instruction{}
+	for i := 0; i < len(ins); {
+		in, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			return nil, &DecodeError{Offset: i, Message: err.Error()}
+		}
+
+		decoded = append(decoded, Instruction{Offset: i, Instruction: in})
+		i += in.Size
+	}
+	return decoded, nil
+}
+
+// every jump target, each must start an instruction or be the end of the stream
+func JumpTargets(decoded []Instruction, length int) (map[int]bool, error) {
+	boundaries := map[int]bool{length: true}
+	for _, in := range decoded {
+		boundaries[in.Offset] = true
+	}
+
+	targets := map[int]bool{}
+	for _, in := range decoded {
+		if !IsJump(in.Op) {
+			continue
+		}
+
+		target := in.Operands[0]
+		if !boundaries[target] {
+			return nil, fmt.Errorf("%04d: %s target %04d is not an instruction boundary", in.Offset, in.Def.Name, target)
+		}
+		targets[target] = true
+	}
+	return targets, nil
+}
+
+func Disassemble(b *compiler.Bytecode) (string, error) {
+	var out strings.Builder
+	if err := Fprint(&out, b); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func Fprint(w io.Writer, b *compiler.Bytecode) error {
+	var out strings.Builder
+
+	for i, constant := range b.Constants {
+		if _, ok := constant.(*code.CompiledFunction); ok {
+			continue
+		}
+
+		value, err := formatConstant(constant)
+		if err != nil {
+			return fmt.Errorf("constant %d: %w", i, err)
+		}
+		fmt.Fprintf(&out, ".const %d %s\n", i, value)
+	}
+	if out.Len() > 0 {
+		out.WriteString("\n")
+	}
+
+	out.WriteString(".func main\n")
+	if err := writeInstructions(&out, b.Instructions, b.Positions, b.Constants); err != nil {
+		return fmt.Errorf("main: %w", err)
+	}
+
+	for i, constant := range b.Constants {
+		fn, ok := constant.(*code.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(&out, "\n.func %d %s params=%d locals=%d\n", i, strconv.Quote(fn.Name), fn.NumParameters, fn.NumLocals)
+		if len(fn.LocalNames) > 0 {
+			names := make([]string, len(fn.LocalNames))
+			for i, name := range fn.LocalNames {
+				names[i] = strconv.Quote(name)
+			}
+			fmt.Fprintf(&out, ".locals %s\n", strings.Join(names, " "))
+		}
+		if err := writeInstructions(&out, fn.Instructions, fn.Positions, b.Constants); err != nil {
+			return fmt.Errorf("constant %d (%s): %w", i, fn.DisplayName(), err)
+		}
+	}
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+func writeInstructions(out *strings.Builder, ins code.Instructions, positions code.PositionTable, constants []object.Object) error {
+	decoded, err := Decode(ins)
+	if err != nil {
+		return err
+	}
+	targets, err := JumpTargets(decoded, len(ins))
+	if err != nil {
+		return err
+	}
+
+	writePositions := func(upTo int) {
+		for len(positions) > 0 && positions[0].Offset <= upTo {
+			pos := positions[0].Pos
+			fmt.Fprintf(out, ".pos %s %d %d\n", strconv.Quote(pos.File), pos.Line, pos.Column)
+			positions = positions[1:]
+		}
+	}
+
+	for _, in := range decoded {
+		if targets[in.Offset] {
+			fmt.Fprintf(out, "%s:\n", Label(in.Offset))
+		}
+		writePositions(in.Offset)
+
+		line := fmt.Sprintf("%04d  %s", in.Offset, formatInstruction(in))
+		if comment := constantComment(in, constants); comment != "" {
+			line = fmt.Sprintf("%-*s; %s", commentColumn, line, comment)
+		}
+		out.WriteString(line + "\n")
+	}
+
+	// a jump past the last instruction still needs somewhere to land
+	if targets[len(ins)] {
+		fmt.Fprintf(out, "%s:\n", Label(len(ins)))
+	}
+	writePositions(len(ins))
+	return nil
+}
+
+func formatInstruction(in Instruction) string {
+	parts := []string{in.Def.Name}
+	if in.Wide {
+		parts = []string{"OpWide", in.Def.Name}
+	}
+	for i, operand := range in.Operands {
+		if i == 0 && IsJump(in.Op) {
+			parts = append(parts, Label(operand))
+			continue
+		}
+		parts = append(parts, strconv.Itoa(operand))
+	}
+	return strings.Join(parts, " ")
+}
+
+func constantComment(in Instruction, constants []object.Object) string {
+	if in.Op != code.OpConstant && in.Op != code.OpClosure {
+		return ""
+	}
+
+	index := in.Operands[0]
+	if index >= len(constants) {
+		return "<constant out of range>"
+	}
+
+	if fn, ok := constants[index].(*code.CompiledFunction); ok {
+		return "fn " + fn.DisplayName()
+	}
+	if value, err := formatConstant(constants[index]); err == nil {
+		_, literal, _ := strings.Cut(value, " ")
+		return literal
+	}
+	return constants[index].Inspect()
+}
+
+// type tag and literal, floats in the shortest form that parses back exactly
+func formatConstant(constant object.Object) (string, error) {
+	switch constant := constant.(type) {
+	case *object.Integer:
+		return "int " + strconv.FormatInt(constant.Value, 10), nil
+	case *object.String:
+		return "string " + strconv.Quote(constant.Value), nil
+	case *code.Float:
+		return "float " + strconv.FormatFloat(constant.Value, 'g', -1, 64), nil
+	default:
+		return "", fmt.Errorf("cannot disassemble constant of type %T", constant)
+	}
+}
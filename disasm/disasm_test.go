@@ -0,0 +1,180 @@
+package disasm
+
+import (
+	"monkey-c/code"
+	"monkey-c/compiler"
+	"monkey-i/lexer"
+	"monkey-i/object"
+	"monkey-i/parser"
+	"strings"
+	"testing"
+)
+
+func compile(t *testing.T, input string) *compiler.Bytecode {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	comp := compiler.New()
+	comp.SetOptimize(false) // keeps the jumps the listing labels
+	if err := comp.Compile(p.ParseProgram()); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return comp.Bytecode()
+}
+
+func concat(ins ...[]byte) code.Instructions {
+	out := code.Instructions{}
+	for _, in := range ins {
+		out = append(out, in...)
+	}
+	return out
+}
+
+func TestDisassemble(t *testing.T) {
+	bytecode := compile(t, `let x = if (true) { 10 } else { 20 }; let greet = fn(name) { "hi " + name }; greet("bob"); fn() { x }`)
+
+	expected := `.const 0 int 10
+.const 1 int 20
+.const 2 string "hi "
+.const 4 string "bob"
+
+.func main
+0000  OpTrue
+0001  OpJumpNotTruthy L0010
+0004  OpConstant 0                  ; 10
+0007  OpJump L0013
+L0010:
+0010  OpConstant 1                  ; 20
+L0013:
+0013  OpSetGlobal 0
+0016  OpClosure 3 0                 ; fn greet
+0020  OpSetGlobal 1
+0023  OpGetGlobal 1
+0026  OpConstant 4                  ; "bob"
+0029  OpCall 1
+0031  OpPop
+0032  OpClosure 5 0                 ; fn <anonymous>
+0036  OpPop
+
+.func 3 "greet" params=1 locals=1
+.locals "name"
+0000  OpConstant 2                  ; "hi "
+0003  OpGetLocal 0
+0005  OpAdd
+0006  OpReturnValue
+
+.func 5 "" params=0 locals=0
+0000  OpGetGlobal 0
+0003  OpReturnValue
+`
+
+	listing, err := Disassemble(bytecode)
+	if err != nil {
+		t.Fatalf("disassemble error: %s", err)
+	}
+	if listing != expected {
+		t.Errorf("wrong listing.\nwant=\n%s\ngot=\n%s", expected, listing)
+	}
+}
+
+func TestDisassembleJumpToEnd(t *testing.T) {
+	bytecode := &compiler.Bytecode{
+		Instructions: concat(code.MustMake(code.OpTrue), code.MustMake(code.OpJumpTruthy, 7), code.MustMake(code.OpConstant, 0)),
+		Constants:    []object.Object{&code.Float{Value: 0.1}},
+	}
+
+	expected := `.const 0 float 0.1
+
+.func main
+0000  OpTrue
+0001  OpJumpTruthy L0007
+0004  OpConstant 0                  ; 0.1
+L0007:
+`
+
+	listing, err := Disassemble(bytecode)
+	if err != nil {
+		t.Fatalf("disassemble error: %s", err)
+	}
+	if listing != expected {
+		t.Errorf("wrong listing.\nwant=\n%s\ngot=\n%s", expected, listing)
+	}
+}
+
+func TestDisassembleMalformed(t *testing.T) {
+	tests := []struct {
+		name     string
+		bytecode *compiler.Bytecode
+		expected string
+	}{
+		{
+			"unknown opcode",
+			&compiler.Bytecode{Instructions: code.Instructions{byte(code.OpTrue), 0xfe}},
+			"main: 0001: opcode 254 undefined",
+		},
+		{
+			"truncated operand",
+			&compiler.Bytecode{Instructions: code.MustMake(code.OpGetGlobal, 1)[:2]},
+			"main: 0000: truncated OpGetGlobal, want 2 operand bytes, have 1",
+		},
+		{
+			"jump into an instruction",
+			&compiler.Bytecode{Instructions: concat(code.MustMake(code.OpJump, 4), code.MustMake(code.OpConstant, 0))},
+			"main: 0000: OpJump target 0004 is not an instruction boundary",
+		},
+		{
+			"jump past the end",
+			&compiler.Bytecode{Instructions: code.MustMake(code.OpJump, 9)},
+			"main: 0000: OpJump target 0009 is not an instruction boundary",
+		},
+		{
+			"malformed function",
+			&compiler.Bytecode{Constants: []object.Object{
+				&code.CompiledFunction{Name: "broken", Instructions: code.Instructions{0xfe}},
+			}},
+			"constant 0 (broken): 0000: opcode 254 undefined",
+		},
+		{
+			"unsupported constant",
+			&compiler.Bytecode{Constants: []object.Object{&object.Boolean{Value: true}}},
+			"constant 0: cannot disassemble constant of type *object.Boolean",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := Disassemble(tt.bytecode)
+		if err == nil {
+			t.Errorf("%s: expected error but resulted in none.", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: wrong error. want=%q, got=%q", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestDisassemblePositions(t *testing.T) {
+	input := "let one = 1;\none;"
+	p := parser.New(lexer.New(input))
+	comp := compiler.New()
+	comp.SetSource("pos.mk", input)
+	if err := comp.Compile(p.ParseProgram()); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	listing, err := Disassemble(comp.Bytecode())
+	if err != nil {
+		t.Fatalf("disassemble error: %s", err)
+	}
+	expected := `.const 0 int 1
+
+.func main
+.pos "pos.mk" 1 11
+0000  OpConstant 0                  ; 1
+.pos "pos.mk" 1 1
+0003  OpSetGlobal 0
+.pos "pos.mk" 2 1
+`
+	if listing != expected {
+		t.Errorf("wrong listing.\nwant=\n%s\ngot=\n%s", expected, listing)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+builders for the AST nodes the monkey-i parser cannot produce yet -> tests
+of the compiler and the VM assemble loops, assignments, logical operators
+and floats from these, the plain parts of a node still come from source
+*/
+package asttest
+
+import (
+	"monkey-c/code"
+	"monkey-i/ast"
+	"monkey-i/lexer"
+	"monkey-i/parser"
+	"strconv"
+)
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+func Stmts(input string) []ast.Statement {
+	return parse(input).Statements
+}
+
+func Expr(input string) ast.Expression {
+	return parse(input).Statements[0].(*ast.ExpressionStatement).Expression
+}
+
+func Program(stmts ...ast.Statement) *ast.Program {
+	return &ast.Program{Statements: stmts}
+}
+
+func Block(stmts ...ast.Statement) *ast.BlockStatement {
+	return &ast.BlockStatement{Statements: stmts}
+}
+
+func ExprStmt(expr ast.Expression) *ast.ExpressionStatement {
+	return &ast.ExpressionStatement{Expression: expr}
+}
+
+func Let(name string, value ast.Expression) *ast.LetStatement {
+	return &ast.LetStatement{Name: &ast.Identifier{Value: name}, Value: value}
+}
+
+// a function literal whose body holds statements source cannot spell
+func Fn(params string, body ...ast.Statement) *ast.FunctionBlock {
+	fn := Expr("fn(" + params + ") { }").(*ast.FunctionBlock)
+	fn.Body = Block(body...)
+	return fn
+}
+
+func If(cond string, consequence ...ast.Statement) *ast.ExpressionStatement {
+	return ExprStmt(&ast.IfExpression{Condition: Expr(cond), Consequence: Block(consequence...)})
+}
+
+func While(cond string, body ...ast.Statement) *code.WhileStatement {
+	return &code.WhileStatement{Condition: Expr(cond), Body: Block(body...)}
+}
+
+func Break() *code.BreakStatement {
+	return &code.BreakStatement{}
+}
+
+func Continue() *code.ContinueStatement {
+	return &code.ContinueStatement{}
+}
+
+func Float(literal string) *code.FloatLiteral {
+	value, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	lit := &code.FloatLiteral{Value: value}
+	lit.Token.Literal = literal
+	return lit
+}
+
+func Infix(left ast.Expression, operator string, right ast.Expression) *ast.InfixExpression {
+	return &ast.InfixExpression{Left: left, Operator: operator, Right: right}
+}
+
+func Logical(left, operator, right string) *ast.InfixExpression {
+	return Infix(Expr(left), operator, Expr(right))
+}
+
+func Assign(target, operator, value string) *ast.ExpressionStatement {
+	return ExprStmt(&code.AssignExpression{
+		InfixExpression: ast.InfixExpression{Left: Expr(target), Operator: operator, Right: Expr(value)},
+	})
+}
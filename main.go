@@ -1,10 +1,409 @@
 package main
 
 import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"monkey-c/compiler"
+	"monkey-c/debugger"
+	"monkey-c/disasm"
 	"monkey-c/repl"
+	"monkey-c/vm"
+	"monkey-i/lexer"
+	"monkey-i/parser"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+// scripts and callers tell failures apart by the exit status
+const (
+	exitOK           = 0
+	exitCompileError = 1
+	exitRuntimeError = 2
+	exitUsage        = 64
+	exitIOError      = 74
+)
+
+const usage = `usage: monkey-c <command> [arguments]
+
+commands:
+  run <file.mk> [flags]          compile and execute a script
+  build <file.mk> [-o file.mkc]  write the compiled bytecode to disk
+  exec <file.mkc> [flags]        execute previously built bytecode
+  disasm <file.mk|file.mkc>      print the bytecode of every function
+  debug <file.mk>                step through a script interactively
+  repl                           start an interactive session
+
+run and exec flags:
+  -trace                         log every instruction, call and global write to stderr
+  -profile file                  count executed instructions and time per call stack into a
+                                 pprof profile in file (exact counts, not sampled), summary to stderr
+  -cover file                    write line and branch coverage, HTML for .html, else LCOV
+
+run, build, disasm and debug flags:
+  -noopt                         keep the bytecode as generated, without the peephole pass
+`
+
 func main() {
-	repl.Start(os.Stdin, os.Stdout)
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		repl.Start(stdin, stdout)
+		return exitOK
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "run":
+		return cmdRun(args, stdout, stderr)
+	case "build":
+		return cmdBuild(args, stderr)
+	case "exec":
+		return cmdExec(args, stdout, stderr)
+	case "disasm":
+		return cmdDisasm(args, stdout, stderr)
+	case "debug":
+		return cmdDebug(args, stdin, stdout, stderr)
+	case "repl":
+		repl.Start(stdin, stdout)
+		return exitOK
+	case "help", "-h", "-help", "--help":
+		io.WriteString(stdout, usage)
+		return exitOK
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", cmd, usage)
+		return exitUsage
+	}
+}
+
+/*
+the flag package stops at the first positional argument, this lets flags
+sit on either side of the file name as in `build file.mk -o file.mkc`
+*/
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// a single file argument, everything else is a usage error
+func singleFile(fs *flag.FlagSet, args []string, stderr io.Writer) (string, int) {
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return "", exitUsage
+	}
+	if len(positional) != 1 {
+		fmt.Fprintf(stderr, "%s expects exactly one file\n\n%s", fs.Name(), usage)
+		return "", exitUsage
+	}
+	return positional[0], exitOK
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+func cmdRun(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("run", stderr)
+	opts := executeFlags(fs)
+	noopt := noOptFlag(fs)
+	file, status := singleFile(fs, args, stderr)
+	if status != exitOK {
+		return status
+	}
+
+	bytecode, status := compileFile(file, !*noopt, stderr)
+	if status != exitOK {
+		return status
+	}
+	return execute(bytecode, opts, stdout, stderr)
+}
+
+func cmdBuild(args []string, stderr io.Writer) int {
+	fs := newFlagSet("build", stderr)
+	out := fs.String("o", "", "output file (default: source name with .mkc)")
+	noopt := noOptFlag(fs)
+	file, status := singleFile(fs, args, stderr)
+	if status != exitOK {
+		return status
+	}
+
+	bytecode, status := compileFile(file, !*noopt, stderr)
+	if status != exitOK {
+		return status
+	}
+
+	if *out == "" {
+		*out = strings.TrimSuffix(file, filepath.Ext(file)) + ".mkc"
+	}
+
+	data, err := bytecode.MarshalBinary()
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", file, err)
+		return exitCompileError
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitIOError
+	}
+	return exitOK
+}
+
+func cmdExec(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("exec", stderr)
+	opts := executeFlags(fs)
+	file, status := singleFile(fs, args, stderr)
+	if status != exitOK {
+		return status
+	}
+
+	bytecode, status := loadBytecode(file, stderr)
+	if status != exitOK {
+		return status
+	}
+
+	// artifacts come from outside the compiler, never trust them blindly
+	if err := vm.Verify(bytecode); err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", file, err)
+		return exitCompileError
+	}
+	return execute(bytecode, opts, stdout, stderr)
+}
+
+func cmdDisasm(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("disasm", stderr)
+	noopt := noOptFlag(fs)
+	file, status := singleFile(fs, args, stderr)
+	if status != exitOK {
+		return status
+	}
+
+	bytecode, status := loadAny(file, !*noopt, stderr)
+	if status != exitOK {
+		return status
+	}
+
+	if err := disasm.Fprint(stdout, bytecode); err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", file, err)
+		return exitCompileError
+	}
+	return exitOK
+}
+
+func cmdDebug(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("debug", stderr)
+	noopt := noOptFlag(fs)
+	file, status := singleFile(fs, args, stderr)
+	if status != exitOK {
+		return status
+	}
+
+	src, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitIOError
+	}
+	comp, status := compileProgram(file, string(src), !*noopt, stderr)
+	if status != exitOK {
+		return status
+	}
+
+	debugger.New(comp.Bytecode(), comp.GlobalNames(), string(src)).Run(stdin, stdout)
+	return exitOK
+}
+
+func noOptFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("noopt", false, "keep the bytecode as generated, without the peephole pass")
+}
+
+func compileFile(file string, optimize bool, stderr io.Writer) (*compiler.Bytecode, int) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return nil, exitIOError
+	}
+	return compileSource(file, string(src), optimize, stderr)
+}
+
+func compileSource(file, input string, optimize bool, stderr io.Writer) (*compiler.Bytecode, int) {
+	comp, status := compileProgram(file, input, optimize, stderr)
+	if status != exitOK {
+		return nil, status
+	}
+	return comp.Bytecode(), exitOK
+}
+
+func compileProgram(file, input string, optimize bool, stderr io.Writer) (*compiler.Compiler, int) {
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		for _, msg := range p.Errors() {
+			fmt.Fprintf(stderr, "%s: %s\n", file, msg)
+		}
+		return nil, exitCompileError
+	}
+
+	comp := compiler.New()
+	comp.SetSource(file, input)
+	comp.SetOptimize(optimize)
+	if err := comp.Compile(program); err != nil {
+		fmt.Fprintln(stderr, err)
+		return nil, exitCompileError
+	}
+	return comp, exitOK
+}
+
+func loadBytecode(file string, stderr io.Writer) (*compiler.Bytecode, int) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return nil, exitIOError
+	}
+	return decodeBytecode(file, data, stderr)
+}
+
+// built artifacts are recognised by their header, anything else is source
+func loadAny(file string, optimize bool, stderr io.Writer) (*compiler.Bytecode, int) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return nil, exitIOError
+	}
+
+	if bytes.HasPrefix(data, []byte(compiler.BytecodeMagic)) {
+		return decodeBytecode(file, data, stderr)
+	}
+	return compileSource(file, string(data), optimize, stderr)
+}
+
+func decodeBytecode(file string, data []byte, stderr io.Writer) (*compiler.Bytecode, int) {
+	bytecode := &compiler.Bytecode{}
+	if err := bytecode.UnmarshalBinary(data); err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", file, err)
+		return nil, exitCompileError
+	}
+	return bytecode, exitOK
+}
+
+type executeOptions struct {
+	trace   *bool
+	profile *string
+	cover   *string
+}
+
+func executeFlags(fs *flag.FlagSet) executeOptions {
+	return executeOptions{
+		trace:   fs.Bool("trace", false, "log every instruction, call and global write to stderr"),
+		profile: fs.String("profile", "", "write executed instruction counts and time per call stack as a pprof profile to `file`, a summary to stderr"),
+		cover:   fs.String("cover", "", "write coverage to `file`, HTML for .html, else LCOV"),
+	}
+}
+
+func execute(bytecode *compiler.Bytecode, opts executeOptions, stdout, stderr io.Writer) int {
+	// the VM takes a single tracer
+	tracers := 0
+	for _, set := range []bool{*opts.trace, *opts.profile != "", *opts.cover != ""} {
+		if set {
+			tracers++
+		}
+	}
+	if tracers > 1 {
+		fmt.Fprintf(stderr, "-trace, -profile and -cover cannot be combined\n")
+		return exitUsage
+	}
+
+	config := vm.DefaultConfig()
+	config.Stdout = stdout
+	machine := vm.New(bytecode, config)
+	var profiler *vm.Profiler
+	var coverage *vm.Coverage
+	switch {
+	case *opts.profile != "":
+		profiler = vm.NewProfiler()
+		machine.SetTracer(profiler)
+	case *opts.cover != "":
+		coverage = vm.NewCoverage(bytecode)
+		machine.SetTracer(coverage)
+	case *opts.trace:
+		machine.SetTracer(vm.NewLogTracer(stderr))
+	}
+
+	err := machine.Run()
+	if profiler != nil {
+		if status := writeProfile(profiler, *opts.profile, stderr); status != exitOK {
+			return status
+		}
+	}
+	if coverage != nil {
+		if status := writeCoverage(coverage, *opts.cover, stderr); status != exitOK {
+			return status
+		}
+	}
+	if err == nil {
+		return exitOK
+	}
+
+	fmt.Fprintf(stderr, "runtime error: %s\n", err)
+	if rtErr, ok := err.(*vm.RuntimeError); ok {
+		io.WriteString(stderr, rtErr.Traceback.String())
+	}
+	return exitRuntimeError
+}
+
+/*
+sources for the HTML report are read from the file names in the position
+tables, a file that cannot be read shows up without its text
+*/
+func writeCoverage(coverage *vm.Coverage, file string, stderr io.Writer) int {
+	var report bytes.Buffer
+	if filepath.Ext(file) == ".html" {
+		sources := map[string]string{}
+		for _, name := range coverage.Files() {
+			if src, err := os.ReadFile(name); err == nil {
+				sources[name] = string(src)
+			}
+		}
+		coverage.WriteHTML(&report, sources)
+	} else {
+		coverage.WriteLCOV(&report)
+	}
+
+	if err := os.WriteFile(file, report.Bytes(), 0644); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitIOError
+	}
+	return exitOK
+}
+
+// a failing program is profiled up to its failure
+func writeProfile(profiler *vm.Profiler, file string, stderr io.Writer) int {
+	profiler.Stop()
+	profiler.WriteReport(stderr)
+
+	out, err := os.Create(file)
+	if err == nil {
+		err = profiler.WritePprof(out)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitIOError
+	}
+	return exitOK
 }
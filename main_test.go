@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"monkey-c/code"
+	"monkey-c/compiler"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeScript(t *testing.T, name, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExitCodes(t *testing.T) {
+	ok := writeScript(t, "ok.mk", "let add = fn(a, b) { a + b }; add(1, 2);")
+	parseErr := writeScript(t, "parse.mk", "let = 1;")
+	compileErr := writeScript(t, "compile.mk", "let x = y;")
+	runtimeErr := writeScript(t, "runtime.mk", "let f = fn(x) { x / 0 };\nf(1);")
+
+	tests := []struct {
+		args     []string
+		expected int
+	}{
+		{[]string{"run", ok}, exitOK},
+		{[]string{"run", parseErr}, exitCompileError},
+		{[]string{"run", compileErr}, exitCompileError},
+		{[]string{"run", runtimeErr}, exitRuntimeError},
+		{[]string{"run", filepath.Join(t.TempDir(), "missing.mk")}, exitIOError},
+		{[]string{"run"}, exitUsage},
+		{[]string{"run", ok, ok}, exitUsage},
+		{[]string{"frobnicate"}, exitUsage},
+		{[]string{"exec", ok}, exitCompileError},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		status := run(tt.args, strings.NewReader(""), &stdout, &stderr)
+		if status != tt.expected {
+			t.Errorf("%v: wrong exit status. want=%d, got=%d (%s)", tt.args, tt.expected, status, stderr.String())
+		}
+	}
+}
+
+func TestBuildExecDisasm(t *testing.T) {
+	src := writeScript(t, "prog.mk", "let f = fn(x) { x / 0 };\nf(1);")
+	out := filepath.Join(t.TempDir(), "prog.mkc")
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"build", src, "-o", out}, nil, &stdout, &stderr); status != exitOK {
+		t.Fatalf("build failed with %d: %s", status, stderr.String())
+	}
+
+	stderr.Reset()
+	if status := run([]string{"exec", out}, nil, &stdout, &stderr); status != exitRuntimeError {
+		t.Fatalf("exec: wrong exit status. want=%d, got=%d", exitRuntimeError, status)
+	}
+	// positions survive the round trip through the artifact
+	if !strings.Contains(stderr.String(), "prog.mk:1:19: division by zero") {
+		t.Errorf("exec: runtime error lost its position. got=%q", stderr.String())
+	}
+
+	for _, file := range []string{src, out} {
+		stdout.Reset()
+		if status := run([]string{"disasm", file}, nil, &stdout, &stderr); status != exitOK {
+			t.Fatalf("disasm %s failed with %d", file, status)
+		}
+		for _, section := range []string{".func main", `.func 1 "f" params=1 locals=1`, "OpDiv"} {
+			if !strings.Contains(stdout.String(), section) {
+				t.Errorf("disasm %s: missing %q in\n%s", file, section, stdout.String())
+			}
+		}
+	}
+}
+
+func TestExecRejectsUnverifiedBytecode(t *testing.T) {
+	// OpPop on an empty stack passes decoding but not verification
+	data, err := (&compiler.Bytecode{Instructions: code.MustMake(code.OpPop)}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeScript(t, "bad.mkc", string(data))
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"exec", path}, nil, &stdout, &stderr); status != exitCompileError {
+		t.Fatalf("wrong exit status. want=%d, got=%d (%s)", exitCompileError, status, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "OpPop pops 1 values, stack holds 0") {
+		t.Errorf("missing verifier diagnostic. got=%q", stderr.String())
+	}
+}
+
+func TestDebug(t *testing.T) {
+	src := writeScript(t, "prog.mk", "let f = fn(x) {\n  x * 2\n};\nf(21);")
+
+	var stdout, stderr bytes.Buffer
+	commands := strings.NewReader("break f\ncontinue\nprint x\ncontinue\n")
+	if status := run([]string{"debug", src}, commands, &stdout, &stderr); status != exitOK {
+		t.Fatalf("debug failed with %d: %s", status, stderr.String())
+	}
+	for _, want := range []string{"breakpoint 1, stopped in f at 0000", "x = 21", "program finished"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("missing %q in\n%s", want, stdout.String())
+		}
+	}
+}
+
+func TestTraceAndProfile(t *testing.T) {
+	src := writeScript(t, "prog.mk", "let f = fn(x) { x * 2 };\nf(21);")
+	profile := filepath.Join(t.TempDir(), "prog.pb.gz")
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"run", "-trace", src}, nil, &stdout, &stderr); status != exitOK {
+		t.Fatalf("run -trace failed with %d: %s", status, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "-> f(21)") {
+		t.Errorf("missing call in trace:\n%s", stderr.String())
+	}
+
+	stderr.Reset()
+	if status := run([]string{"run", src, "-profile", profile}, nil, &stdout, &stderr); status != exitOK {
+		t.Fatalf("run -profile failed with %d: %s", status, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "OpMul") {
+		t.Errorf("missing opcode counts in summary:\n%s", stderr.String())
+	}
+	if info, err := os.Stat(profile); err != nil || info.Size() == 0 {
+		t.Errorf("no profile written: %v", err)
+	}
+}
+
+func TestCover(t *testing.T) {
+	src := writeScript(t, "prog.mk", "let f = fn(x) { if (x > 1) { x } };\nf(2);")
+	dir := t.TempDir()
+
+	var stdout, stderr bytes.Buffer
+	lcov := filepath.Join(dir, "prog.info")
+	if status := run([]string{"run", "-cover", lcov, src}, nil, &stdout, &stderr); status != exitOK {
+		t.Fatalf("run -cover failed with %d: %s", status, stderr.String())
+	}
+	if data, err := os.ReadFile(lcov); err != nil || !strings.Contains(string(data), "BRDA:1,0,0,1") {
+		t.Errorf("wrong lcov report (%v):\n%s", err, data)
+	}
+
+	report := filepath.Join(dir, "prog.html")
+	if status := run([]string{"run", "-cover", report, src}, nil, &stdout, &stderr); status != exitOK {
+		t.Fatalf("run -cover failed with %d: %s", status, stderr.String())
+	}
+	if data, err := os.ReadFile(report); err != nil || !strings.Contains(string(data), "<html") {
+		t.Errorf("wrong html report (%v):\n%s", err, data)
+	}
+
+	stderr.Reset()
+	if status := run([]string{"run", "-trace", "-cover", lcov, src}, nil, &stdout, &stderr); status != exitUsage {
+		t.Errorf("combining -trace and -cover exited with %d", status)
+	}
+}
+
+func TestNoOpt(t *testing.T) {
+	src := writeScript(t, "prog.mk", "if (true) { 1 }; 2;")
+
+	for _, tt := range []struct {
+		args   []string
+		opTrue bool
+	}{
+		{[]string{"disasm", src}, false},
+		{[]string{"disasm", "-noopt", src}, true},
+	} {
+		var stdout, stderr bytes.Buffer
+		if status := run(tt.args, nil, &stdout, &stderr); status != exitOK {
+			t.Fatalf("%v failed with %d: %s", tt.args, status, stderr.String())
+		}
+		if strings.Contains(stdout.String(), "OpTrue") != tt.opTrue {
+			t.Errorf("%v: OpTrue in listing should be %t:\n%s", tt.args, tt.opTrue, stdout.String())
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"run", "-noopt", src}, nil, &stdout, &stderr); status != exitOK {
+		t.Errorf("run -noopt failed with %d: %s", status, stderr.String())
+	}
+}
+
+func TestProgramOutput(t *testing.T) {
+	src := writeScript(t, "prog.mk", `puts("hello");`)
+	out := filepath.Join(t.TempDir(), "prog.mkc")
+
+	for _, args := range [][]string{{"build", src, "-o", out}, {"run", src}, {"exec", out}} {
+		var stdout, stderr bytes.Buffer
+		if status := run(args, nil, &stdout, &stderr); status != exitOK {
+			t.Fatalf("%v failed with %d: %s", args, status, stderr.String())
+		}
+		if args[0] != "build" && stdout.String() != "hello\n" {
+			t.Errorf("%v: wrong output. got=%q", args, stdout.String())
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	run([]string{"repl"}, strings.NewReader(`puts("hi")`+"\n"), &stdout, &stderr)
+	if !strings.Contains(stdout.String(), "hi\n") {
+		t.Errorf("repl: missing output in %q", stdout.String())
+	}
+}
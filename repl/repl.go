@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"monkey-c/code"
 	"monkey-c/compiler"
 	"monkey-c/vm"
 	"monkey-i/lexer"
@@ -18,6 +19,9 @@ func Start(in io.Reader, out io.Writer) {
 	constants := []object.Object{}
 	globals := make([]object.Object, vm.GlobalsSize)
 	symbolTable := compiler.NewSymbolTable()
+	for i, v := range code.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
 
 	for {
 		fmt.Fprintf(out, repl.PROMPT)
@@ -38,19 +42,25 @@ func Start(in io.Reader, out io.Writer) {
 		}
 
 		comp := compiler.NewWithState(symbolTable, constants)
+		comp.SetSource("", line)
 		err := comp.Compile(program)
 		if err != nil {
 			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
 			continue
 		}
 
-		code := comp.Bytecode()
-		constants = code.Constants
-		machine := vm.NewWithGlobalsStore(code, globals)
+		bytecode := comp.Bytecode()
+		constants = bytecode.Constants
+		config := vm.DefaultConfig()
+		config.Stdout = out
+		machine := vm.NewWithGlobalsStore(bytecode, config, globals)
 
 		err = machine.Run()
 		if err != nil {
 			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
+			if rtErr, ok := err.(*vm.RuntimeError); ok {
+				io.WriteString(out, rtErr.Traceback.String())
+			}
 			continue
 		}
 
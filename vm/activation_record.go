@@ -6,12 +6,31 @@ type ActivationRecord struct {
 	cl                 *code.Closure
 	instructionPointer int
 	basePointer        int
+	currentOp          int // offset of the instruction last started, OpWide prefix included
 }
 
 func (ar *ActivationRecord) Instructions() code.Instructions {
 	return ar.cl.Fn.Instructions
 }
 
+// offset of the next instruction to run
+func (ar *ActivationRecord) IP() int {
+	return ar.instructionPointer + 1
+}
+
+func (ar *ActivationRecord) Function() *code.CompiledFunction {
+	return ar.cl.Fn
+}
+
+// stack index of the first local, arguments come first
+func (ar *ActivationRecord) BasePointer() int {
+	return ar.basePointer
+}
+
+func (ar *ActivationRecord) FunctionName() string {
+	return ar.cl.Fn.DisplayName()
+}
+
 func NewRecord(cl *code.Closure, basePointer int) *ActivationRecord {
 	return &ActivationRecord{
 		cl:                 cl,
@@ -0,0 +1,50 @@
+package vm
+
+import (
+	"io"
+	"os"
+)
+
+/*
+resource limits of one VM, for running scripts that cannot be trusted ->
+running into any of them stops the program with a *RuntimeError of the
+matching Kind instead of exhausting the host.
+zero fields take the defaults, so Config{MaxInstructions: 1e6} only adds
+an instruction budget
+*/
+type Config struct {
+	StackSize   int // value slots shared by all frames
+	MaxFrames   int // nested calls, main included
+	GlobalsSize int
+
+	MaxInstructions int64 // instructions executed, 0 -> unlimited
+	MaxHeapObjects  int   // arrays, hashes, strings, closures and cells allocated, 0 -> unlimited
+
+	Stdout io.Writer // where puts writes, nil -> os.Stdout
+}
+
+func DefaultConfig() Config {
+	return Config{
+		StackSize:   StackLim,
+		MaxFrames:   ActivationRecordSize,
+		GlobalsSize: GlobalsSize,
+		Stdout:      os.Stdout,
+	}
+}
+
+func (c Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if c.StackSize <= 0 {
+		c.StackSize = defaults.StackSize
+	}
+	if c.MaxFrames <= 0 {
+		c.MaxFrames = defaults.MaxFrames
+	}
+	if c.GlobalsSize <= 0 {
+		c.GlobalsSize = defaults.GlobalsSize
+	}
+	if c.Stdout == nil {
+		c.Stdout = defaults.Stdout
+	}
+	return c
+}
@@ -0,0 +1,297 @@
+package vm
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"monkey-c/code"
+	"monkey-c/compiler"
+	"monkey-i/object"
+	"sort"
+	"strings"
+)
+
+/*
+a Tracer recording which instructions of a program ran and which way its
+conditional jumps went -> lines come from the position tables, a line
+counts as run as often as its most run instruction. functions without
+positions (assembled ones) are counted but cannot be reported
+*/
+type Coverage struct {
+	functions map[*code.CompiledFunction]*functionCoverage
+	main      *functionCoverage
+	order     []*functionCoverage
+
+	pending *branchCoverage // the conditional jump that ran last, its outcome shows with the next instruction
+}
+
+type functionCoverage struct {
+	fn       *code.CompiledFunction
+	name     string
+	calls    int64
+	hits     map[int]int64 // instruction offset -> times run
+	offsets  []int         // of every instruction, in order
+	branches map[int]*branchCoverage
+}
+
+/*
+for OpJumpNotTruthy the jump is taken when the condition is falsy, for
+OpJumpTruthy when it is truthy
+*/
+type branchCoverage struct {
+	op       code.Opcode
+	target   int
+	taken    int64
+	notTaken int64
+}
+
+func NewCoverage(bytecode *compiler.Bytecode) *Coverage {
+	c := &Coverage{functions: map[*code.CompiledFunction]*functionCoverage{}}
+	c.main = c.add(&code.CompiledFunction{Instructions: bytecode.Instructions, Name: "<main>", Positions: bytecode.Positions})
+	for _, constant := range bytecode.Constants {
+		if fn, ok := constant.(*code.CompiledFunction); ok {
+			c.functions[fn] = c.add(fn)
+		}
+	}
+	return c
+}
+
+func (c *Coverage) add(fn *code.CompiledFunction) *functionCoverage {
+	f := &functionCoverage{fn: fn, name: fn.DisplayName(), hits: map[int]int64{}, branches: map[int]*branchCoverage{}}
+	for i := 0; i < len(fn.Instructions); {
+		in, err := code.ReadInstruction(fn.Instructions, i)
+		if err != nil {
+			break
+		}
+		f.offsets = append(f.offsets, i)
+		if in.Op == code.OpJumpNotTruthy || in.Op == code.OpJumpTruthy {
+			f.branches[i] = &branchCoverage{op: in.Op, target: in.Operands[0]}
+		}
+		i += in.Size
+	}
+	c.order = append(c.order, f)
+	return f
+}
+
+func (c *Coverage) Dispatch(fn *code.CompiledFunction, ip int, op code.Opcode, operands []int, stackDepth int) {
+	if c.pending != nil {
+		if ip == c.pending.target {
+			c.pending.taken++
+		} else {
+			c.pending.notTaken++
+		}
+		c.pending = nil
+	}
+
+	// the VM wraps main in a function of its own
+	f, ok := c.functions[fn]
+	if !ok {
+		f = c.main
+	}
+	f.hits[ip]++
+	c.pending = f.branches[ip]
+}
+
+// counted on entry, a loop at the start of a function jumps back to offset 0
+func (c *Coverage) Enter(fn *code.CompiledFunction, args []object.Object) {
+	if f, ok := c.functions[fn]; ok {
+		f.calls++
+	}
+}
+
+func (c *Coverage) Exit(fn *code.CompiledFunction, result object.Object) {}
+func (c *Coverage) SetGlobal(index int, value object.Object)             {}
+
+type lineCoverage struct {
+	line     int
+	hits     int64
+	branches []*branchCoverage
+}
+
+type fileFunction struct {
+	name  string
+	line  int
+	calls int64
+}
+
+type fileCoverage struct {
+	name      string
+	lines     map[int]*lineCoverage
+	functions []fileFunction
+}
+
+// what ran, grouped by the source file of the positions
+func (c *Coverage) files() []*fileCoverage {
+	files := map[string]*fileCoverage{}
+	names := []string{}
+
+	for _, f := range c.order {
+		if len(f.fn.Positions) == 0 {
+			continue
+		}
+
+		file, ok := files[f.fn.Positions[0].Pos.File]
+		if !ok {
+			file = &fileCoverage{name: f.fn.Positions[0].Pos.File, lines: map[int]*lineCoverage{}}
+			files[file.name] = file
+			names = append(names, file.name)
+		}
+
+		if f != c.main {
+			file.functions = append(file.functions, fileFunction{name: f.name, line: f.fn.Positions[0].Pos.Line, calls: f.calls})
+		}
+		for _, offset := range f.offsets {
+			pos, ok := f.fn.Positions.Lookup(offset)
+			if !ok {
+				continue
+			}
+			line, ok := file.lines[pos.Line]
+			if !ok {
+				line = &lineCoverage{line: pos.Line}
+				file.lines[pos.Line] = line
+			}
+			if f.hits[offset] > line.hits {
+				line.hits = f.hits[offset]
+			}
+			if branch, ok := f.branches[offset]; ok {
+				line.branches = append(line.branches, branch)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	result := make([]*fileCoverage, len(names))
+	for i, name := range names {
+		result[i] = files[name]
+	}
+	return result
+}
+
+// source files the report covers, for loading their text
+func (c *Coverage) Files() []string {
+	names := []string{}
+	for _, file := range c.files() {
+		names = append(names, file.name)
+	}
+	return names
+}
+
+func (f *fileCoverage) sortedLines() []*lineCoverage {
+	lines := make([]*lineCoverage, 0, len(f.lines))
+	for _, line := range f.lines {
+		lines = append(lines, line)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].line < lines[j].line })
+	return lines
+}
+
+/*
+one LCOV record per source file -> branch 0 of a conditional jump is
+falling through, branch 1 jumping, functions sharing a name get their
+line appended so genhtml keeps them apart
+*/
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	var out strings.Builder
+	for _, file := range c.files() {
+		fmt.Fprintf(&out, "TN:\nSF:%s\n", file.name)
+
+		seen := map[string]int{}
+		for _, fn := range file.functions {
+			seen[fn.name]++
+		}
+		hitFunctions := 0
+		for _, fn := range file.functions {
+			name := fn.name
+			if seen[name] > 1 {
+				name = fmt.Sprintf("%s@%d", name, fn.line)
+			}
+			fmt.Fprintf(&out, "FN:%d,%s\n", fn.line, name)
+			fmt.Fprintf(&out, "FNDA:%d,%s\n", fn.calls, name)
+			if fn.calls > 0 {
+				hitFunctions++
+			}
+		}
+		fmt.Fprintf(&out, "FNF:%d\nFNH:%d\n", len(file.functions), hitFunctions)
+
+		lines := file.sortedLines()
+		branches, hitBranches, block := 0, 0, 0
+		for _, line := range lines {
+			for _, branch := range line.branches {
+				for i, count := range []int64{branch.notTaken, branch.taken} {
+					taken := "-" // the jump never ran
+					if branch.taken+branch.notTaken > 0 {
+						taken = fmt.Sprint(count)
+					}
+					fmt.Fprintf(&out, "BRDA:%d,%d,%d,%s\n", line.line, block, i, taken)
+					branches++
+					if count > 0 {
+						hitBranches++
+					}
+				}
+				block++
+			}
+		}
+		fmt.Fprintf(&out, "BRF:%d\nBRH:%d\n", branches, hitBranches)
+
+		hitLines := 0
+		for _, line := range lines {
+			fmt.Fprintf(&out, "DA:%d,%d\n", line.line, line.hits)
+			if line.hits > 0 {
+				hitLines++
+			}
+		}
+		fmt.Fprintf(&out, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hitLines)
+	}
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+const coverageStyle = `body { font-family: monospace; }
+pre { margin: 0; }
+.hit { background: #d4f7d4; }
+.miss { background: #f7d4d4; }
+.partial { background: #f7f0c4; }
+.count { color: #777; display: inline-block; width: 6em; text-align: right; margin-right: 1em; }`
+
+/*
+every source file with its lines marked run, not run or partially run,
+the last when one of the conditional jumps on it only ever went one way.
+sources maps the file names of the positions to their text
+*/
+func (c *Coverage) WriteHTML(w io.Writer, sources map[string]string) error {
+	var out strings.Builder
+	fmt.Fprintf(&out, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>coverage</title>\n<style>\n%s\n</style>\n</head>\n<body>\n", coverageStyle)
+
+	for _, file := range c.files() {
+		hitLines := 0
+		for _, line := range file.lines {
+			if line.hits > 0 {
+				hitLines++
+			}
+		}
+		fmt.Fprintf(&out, "<h2>%s: %d of %d lines run</h2>\n", html.EscapeString(file.name), hitLines, len(file.lines))
+
+		for i, text := range strings.Split(sources[file.name], "\n") {
+			class, count, title := "", "", ""
+			if line, ok := file.lines[i+1]; ok {
+				class, count = "hit", fmt.Sprint(line.hits)
+				if line.hits == 0 {
+					class = "miss"
+				}
+				for _, branch := range line.branches {
+					title += fmt.Sprintf("%s jumped %d, fell through %d. ", opcodeName(branch.op), branch.taken, branch.notTaken)
+					if line.hits > 0 && (branch.taken == 0 || branch.notTaken == 0) {
+						class = "partial"
+					}
+				}
+			}
+			fmt.Fprintf(&out, "<pre class=\"%s\" title=\"%s\"><span class=\"count\">%s</span>%4d  %s</pre>\n",
+				class, html.EscapeString(strings.TrimSpace(title)), count, i+1, html.EscapeString(text))
+		}
+	}
+
+	out.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, out.String())
+	return err
+}
@@ -0,0 +1,78 @@
+package vm
+
+import (
+	"fmt"
+	"monkey-c/code"
+)
+
+type ErrorKind string
+
+const (
+	DivisionByZero ErrorKind = "division by zero"
+	TypeMismatch   ErrorKind = "type mismatch"
+	StackOverflow  ErrorKind = "stack overflow"
+	StackUnderflow ErrorKind = "stack underflow"
+	InvalidIndex   ErrorKind = "invalid index"
+	InvalidCall    ErrorKind = "invalid call"
+	InternalError  ErrorKind = "internal error"
+	// limits set by Config
+	GlobalsExhausted ErrorKind = "globals exhausted"
+	InstructionLimit ErrorKind = "instruction limit exceeded"
+	HeapLimit        ErrorKind = "heap limit exceeded"
+)
+
+/*
+every fault raised while running bytecode -> Opcode and Offset point at the
+instruction that failed inside Function (the compiled function it belongs to),
+Traceback holds every frame that was active at the time
+*/
+type RuntimeError struct {
+	Kind      ErrorKind
+	Message   string
+	Opcode    code.Opcode
+	Offset    int
+	Function  string
+	Pos       code.Position
+	Traceback Traceback
+}
+
+func (e *RuntimeError) Error() string {
+	opName := fmt.Sprintf("opcode %d", e.Opcode)
+	if def, err := code.Lookup(byte(e.Opcode)); err == nil {
+		opName = def.Name
+	}
+	msg := fmt.Sprintf("%s (%s at %04d in %s)", e.Message, opName, e.Offset, e.Function)
+	if e.Pos.IsValid() {
+		return e.Pos.String() + ": " + msg
+	}
+	return msg
+}
+
+func runtimeErrorf(kind ErrorKind, format string, a ...interface{}) *RuntimeError {
+	return &RuntimeError{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+func panicToRuntimeError(r interface{}) *RuntimeError {
+	switch r := r.(type) {
+	case *RuntimeError:
+		return r
+	case error:
+		return runtimeErrorf(InternalError, "%s", r)
+	default:
+		return runtimeErrorf(InternalError, "%v", r)
+	}
+}
+
+func (vm *VM) locateError(err error, op code.Opcode, ip int, record *ActivationRecord) error {
+	rtErr, ok := err.(*RuntimeError)
+	if !ok {
+		rtErr = runtimeErrorf(InternalError, "%s", err)
+	}
+
+	rtErr.Opcode = op
+	rtErr.Offset = ip
+	rtErr.Function = record.FunctionName()
+	rtErr.Pos, _ = record.cl.Fn.Positions.Lookup(ip)
+	rtErr.Traceback = vm.tracebackAt(record, ip)
+	return rtErr
+}
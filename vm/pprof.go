@@ -0,0 +1,176 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"monkey-c/code"
+	"sort"
+	"strings"
+)
+
+/*
+WritePprof writes the counts as a gzipped profile.proto, readable by
+`go tool pprof` -> every Sample message is one call stack of (function,
+line) locations with two values, executed_instructions and wall_time.
+nothing is sampled, the values are exact totals over the run, so the
+period is a single instruction. the encoding is written by hand, the
+profile only needs a few messages
+*/
+func (p *Profiler) WritePprof(w io.Writer) error {
+	table := newStringTable()
+	profile := &protoBuffer{}
+
+	for _, sampleType := range [][2]string{{"executed_instructions", "count"}, {"wall_time", "nanoseconds"}} {
+		valueType := &protoBuffer{}
+		valueType.int64Field(1, table.index(sampleType[0]))
+		valueType.int64Field(2, table.index(sampleType[1]))
+		profile.messageField(1, valueType)
+	}
+
+	for _, key := range sortedKeys(p.stacks) {
+		s := p.stacks[key]
+		sample := &protoBuffer{}
+		ids := make([]uint64, len(s.locations))
+		for i, id := range s.locations {
+			ids[i] = uint64(id)
+		}
+		sample.packedField(1, ids)
+		sample.packedField(2, []uint64{uint64(s.instructions), uint64(s.nanos)})
+		profile.messageField(2, sample)
+	}
+
+	functionIDs := map[*code.CompiledFunction]int{}
+	for _, fn := range p.order {
+		functionIDs[fn] = len(functionIDs) + 1
+	}
+
+	locations := make([]profileLocation, len(p.locations))
+	for loc, id := range p.locations {
+		locations[id-1] = loc
+	}
+	for i, loc := range locations {
+		line := &protoBuffer{}
+		line.uint64Field(1, uint64(functionIDs[loc.fn]))
+		line.int64Field(2, int64(loc.line))
+
+		location := &protoBuffer{}
+		location.uint64Field(1, uint64(i+1))
+		location.messageField(4, line)
+		profile.messageField(4, location)
+	}
+
+	for _, fn := range p.order {
+		start, file := 0, ""
+		if len(fn.Positions) > 0 {
+			start, file = fn.Positions[0].Pos.Line, fn.Positions[0].Pos.File
+		}
+
+		// pprof drops <...> from names like C++ template arguments
+		name := strings.Trim(p.functions[fn].Name, "<>")
+
+		function := &protoBuffer{}
+		function.uint64Field(1, uint64(functionIDs[fn]))
+		function.int64Field(2, table.index(name))
+		function.int64Field(3, table.index(name))
+		function.int64Field(4, table.index(file))
+		function.int64Field(5, int64(start))
+		profile.messageField(5, function)
+	}
+
+	periodType := &protoBuffer{}
+	periodType.int64Field(1, table.index("executed_instructions"))
+	periodType.int64Field(2, table.index("count"))
+
+	// the string table goes last, every other message has added its strings by now
+	for _, s := range table.strings {
+		profile.stringField(6, s)
+	}
+	profile.int64Field(9, p.started.UnixNano())
+	profile.int64Field(10, int64(p.stopped.Sub(p.started)))
+	profile.messageField(11, periodType)
+	profile.int64Field(12, 1)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(profile.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+type stringTable struct {
+	strings []string
+	indexes map[string]int64
+}
+
+// pprof wants the empty string at index 0
+func newStringTable() *stringTable {
+	return &stringTable{strings: []string{""}, indexes: map[string]int64{"": 0}}
+}
+
+func (t *stringTable) index(s string) int64 {
+	i, ok := t.indexes[s]
+	if !ok {
+		i = int64(len(t.strings))
+		t.strings = append(t.strings, s)
+		t.indexes[s] = i
+	}
+	return i
+}
+
+func sortedKeys(stacks map[string]*stackCount) []string {
+	keys := make([]string, 0, len(stacks))
+	for key := range stacks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// protobuf wire format, varint (0) and length delimited (2) fields only
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (b *protoBuffer) key(field, wireType int) {
+	b.varint(uint64(field<<3 | wireType))
+}
+
+// zero is the default and left out
+func (b *protoBuffer) uint64Field(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(v)
+}
+
+func (b *protoBuffer) int64Field(field int, v int64) {
+	b.uint64Field(field, uint64(v))
+}
+
+func (b *protoBuffer) stringField(field int, s string) {
+	b.key(field, 2)
+	b.varint(uint64(len(s)))
+	b.WriteString(s)
+}
+
+func (b *protoBuffer) messageField(field int, m *protoBuffer) {
+	b.key(field, 2)
+	b.varint(uint64(m.Len()))
+	b.Write(m.Bytes())
+}
+
+func (b *protoBuffer) packedField(field int, vs []uint64) {
+	packed := &protoBuffer{}
+	for _, v := range vs {
+		packed.varint(v)
+	}
+	b.messageField(field, packed)
+}
@@ -0,0 +1,263 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"monkey-c/code"
+	"monkey-i/object"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+a Tracer counting what a program does -> every instruction is counted per
+opcode, per function and per call stack, and every frame is timed from
+its call to its return. nothing is sampled, each dispatch is seen, and the
+time between two dispatches is charged to the stack that ran the first
+one. the per-stack counts are what WritePprof exports:
+
+	vm.SetTracer(p)
+	err := vm.Run()
+	p.Stop()
+	p.WritePprof(w)
+*/
+type Profiler struct {
+	now func() time.Time
+
+	opcodes   [256]int64
+	functions map[*code.CompiledFunction]*FunctionProfile
+	order     []*code.CompiledFunction // first seen first, for stable output
+	frames    []*profileFrame
+	active    map[*code.CompiledFunction]int // open frames per function, recursion counts once
+
+	stacks    map[string]*stackCount
+	locations map[profileLocation]int // -> location id
+	last      *stackCount
+	lastTime  time.Time
+	started   time.Time
+	stopped   time.Time
+}
+
+type FunctionProfile struct {
+	Name         string
+	Calls        int64
+	Instructions int64
+	Inclusive    time.Duration // call to return, calls it made included
+	Exclusive    time.Duration // without the time spent in the calls it made
+
+	fn *code.CompiledFunction
+}
+
+type profileFrame struct {
+	fn       *code.CompiledFunction
+	start    time.Time
+	children time.Duration
+	line     int
+	key      string // location ids of the callers, innermost last
+	stack    *stackCount
+}
+
+type profileLocation struct {
+	fn   *code.CompiledFunction
+	line int
+}
+
+type stackCount struct {
+	locations    []int // leaf first
+	instructions int64
+	nanos        int64
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{
+		now:       time.Now,
+		functions: map[*code.CompiledFunction]*FunctionProfile{},
+		active:    map[*code.CompiledFunction]int{},
+		stacks:    map[string]*stackCount{},
+		locations: map[profileLocation]int{},
+	}
+}
+
+func (p *Profiler) Dispatch(fn *code.CompiledFunction, ip int, op code.Opcode, operands []int, stackDepth int) {
+	now := p.now()
+	p.charge(now)
+
+	if len(p.frames) == 0 {
+		// main has no call of its own, it starts with its first instruction.
+		// attached mid-run, whatever runs first becomes the root instead
+		p.push(fn, now, "")
+	}
+	frame := p.frames[len(p.frames)-1]
+
+	pos, _ := fn.Positions.Lookup(ip)
+	if frame.stack == nil || pos.Line != frame.line {
+		frame.line = pos.Line
+		frame.stack = p.stackOf(frame)
+	}
+
+	p.opcodes[op]++
+	p.functions[fn].Instructions++
+	frame.stack.instructions++
+	p.last = frame.stack
+}
+
+func (p *Profiler) Enter(fn *code.CompiledFunction, args []object.Object) {
+	now := p.now()
+	p.charge(now)
+
+	key := ""
+	if len(p.frames) > 0 {
+		caller := p.frames[len(p.frames)-1]
+		key = caller.key + strconv.Itoa(p.location(caller.fn, caller.line)) + ","
+	}
+	p.push(fn, now, key)
+}
+
+func (p *Profiler) Exit(fn *code.CompiledFunction, result object.Object) {
+	now := p.now()
+	p.charge(now)
+	p.pop(now)
+}
+
+func (p *Profiler) SetGlobal(index int, value object.Object) {}
+
+/*
+closes the frames a runtime error or cancellation left open, call it once
+Run returned and before reading results
+*/
+func (p *Profiler) Stop() {
+	now := p.now()
+	p.charge(now)
+	for len(p.frames) > 0 {
+		p.pop(now)
+	}
+	p.stopped = now
+}
+
+func (p *Profiler) push(fn *code.CompiledFunction, now time.Time, key string) {
+	if p.started.IsZero() {
+		p.started = now
+	}
+	profile, ok := p.functions[fn]
+	if !ok {
+		profile = &FunctionProfile{Name: fn.DisplayName(), fn: fn}
+		p.functions[fn] = profile
+		p.order = append(p.order, fn)
+	}
+	profile.Calls++
+	p.active[fn]++
+	p.frames = append(p.frames, &profileFrame{fn: fn, start: now, key: key})
+}
+
+// a return from a frame pushed before the profiler was attached has nothing to close
+func (p *Profiler) pop(now time.Time) {
+	if len(p.frames) == 0 {
+		return
+	}
+	frame := p.frames[len(p.frames)-1]
+	p.frames = p.frames[:len(p.frames)-1]
+
+	elapsed := now.Sub(frame.start)
+	profile := p.functions[frame.fn]
+	profile.Exclusive += elapsed - frame.children
+	if p.active[frame.fn]--; p.active[frame.fn] == 0 {
+		profile.Inclusive += elapsed
+	}
+	if len(p.frames) > 0 {
+		p.frames[len(p.frames)-1].children += elapsed
+	}
+}
+
+// the time since the previous event went to the stack that was running
+func (p *Profiler) charge(now time.Time) {
+	if p.last != nil {
+		p.last.nanos += int64(now.Sub(p.lastTime))
+	}
+	p.last, p.lastTime = nil, now
+	if len(p.frames) > 0 {
+		p.last = p.frames[len(p.frames)-1].stack
+	}
+}
+
+func (p *Profiler) location(fn *code.CompiledFunction, line int) int {
+	loc := profileLocation{fn: fn, line: line}
+	id, ok := p.locations[loc]
+	if !ok {
+		id = len(p.locations) + 1
+		p.locations[loc] = id
+	}
+	return id
+}
+
+func (p *Profiler) stackOf(frame *profileFrame) *stackCount {
+	key := frame.key + strconv.Itoa(p.location(frame.fn, frame.line))
+	s, ok := p.stacks[key]
+	if !ok {
+		s = &stackCount{}
+		for _, id := range splitIDs(key) {
+			s.locations = append([]int{id}, s.locations...)
+		}
+		p.stacks[key] = s
+	}
+	return s
+}
+
+func splitIDs(key string) []int {
+	ids := []int{}
+	start := 0
+	for i := 0; i <= len(key); i++ {
+		if i == len(key) || key[i] == ',' {
+			id, _ := strconv.Atoi(key[start:i])
+			ids = append(ids, id)
+			start = i + 1
+		}
+	}
+	return ids
+}
+
+// opcodes that ran at least once, most executed first
+func (p *Profiler) Opcodes() []OpcodeCount {
+	counts := []OpcodeCount{}
+	for op, n := range p.opcodes {
+		if n > 0 {
+			counts = append(counts, OpcodeCount{Op: code.Opcode(op), Count: n})
+		}
+	}
+	sort.SliceStable(counts, func(i, j int) bool { return counts[i].Count > counts[j].Count })
+	return counts
+}
+
+type OpcodeCount struct {
+	Op    code.Opcode
+	Count int64
+}
+
+// every function that ran, most exclusive time first
+func (p *Profiler) Functions() []FunctionProfile {
+	profiles := make([]FunctionProfile, 0, len(p.order))
+	for _, fn := range p.order {
+		profiles = append(profiles, *p.functions[fn])
+	}
+	sort.SliceStable(profiles, func(i, j int) bool { return profiles[i].Exclusive > profiles[j].Exclusive })
+	return profiles
+}
+
+func (p *Profiler) WriteReport(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "function\tcalls\tinstructions\tinclusive\texclusive\n")
+	for _, f := range p.Functions() {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", f.Name, f.Calls, f.Instructions, f.Inclusive, f.Exclusive)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(tw, "opcode\tcount\n")
+	for _, c := range p.Opcodes() {
+		fmt.Fprintf(tw, "%s\t%d\n", opcodeName(c.Op), c.Count)
+	}
+	return tw.Flush()
+}
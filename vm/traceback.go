@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"fmt"
+	"monkey-c/code"
+	"strings"
+)
+
+// frames past this many are elided in the middle when printing
+const tracebackPrintLimit = 20
+
+/*
+one active ActivationRecord -> Offset is the instruction the frame is
+executing, for every caller that is the OpCall waiting on the next frame
+*/
+type Frame struct {
+	Function string
+	Offset   int
+	Pos      code.Position
+}
+
+func (f Frame) String() string {
+	res := fmt.Sprintf("%s at %04d", f.Function, f.Offset)
+	if f.Pos.IsValid() {
+		res += " (" + f.Pos.String() + ")"
+	}
+	return res
+}
+
+// outermost frame first, like python the failing call is printed last
+type Traceback []Frame
+
+func (tb Traceback) String() string {
+	var out strings.Builder
+	out.WriteString("traceback (most recent call last):\n")
+
+	for i, frame := range tb {
+		if len(tb) > tracebackPrintLimit {
+			half := tracebackPrintLimit / 2
+			if i == half {
+				fmt.Fprintf(&out, "  ... %d frames omitted\n", len(tb)-tracebackPrintLimit)
+			}
+			if i >= half && i < len(tb)-half {
+				continue
+			}
+		}
+		fmt.Fprintf(&out, "  %s\n", frame)
+	}
+
+	return out.String()
+}
+
+func newFrame(record *ActivationRecord, offset int) Frame {
+	pos, _ := record.cl.Fn.Positions.Lookup(offset)
+	return Frame{Function: record.FunctionName(), Offset: offset, Pos: pos}
+}
+
+// every active frame, the innermost one at the instruction it last executed
+func (vm *VM) Traceback() Traceback {
+	tb := make(Traceback, 0, vm.recordPointer)
+	for i := 0; i < vm.recordPointer; i++ {
+		record := vm.activationRecords[i]
+		tb = append(tb, newFrame(record, record.currentOp))
+	}
+	return tb
+}
+
+/*
+the frames active when failing ran the instruction at ip -> failing may
+already be popped (a return that faulted) and is then appended as innermost
+*/
+func (vm *VM) tracebackAt(failing *ActivationRecord, ip int) Traceback {
+	tb := make(Traceback, 0, vm.recordPointer+1)
+	for i := 0; i < vm.recordPointer; i++ {
+		record := vm.activationRecords[i]
+		if record == failing {
+			return append(tb, newFrame(record, ip))
+		}
+		tb = append(tb, newFrame(record, record.currentOp))
+	}
+	return append(tb, newFrame(failing, ip))
+}
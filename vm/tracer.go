@@ -0,0 +1,85 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"monkey-c/code"
+	"monkey-i/object"
+	"strings"
+)
+
+/*
+observes a running VM without changing it -> callbacks run synchronously
+inside the dispatch loop, so they must not keep operands or args around
+past the call. with no tracer set the loop pays a single nil check
+*/
+type Tracer interface {
+	// before the instruction at ip of fn runs, stackDepth values are on the stack
+	Dispatch(fn *code.CompiledFunction, ip int, op code.Opcode, operands []int, stackDepth int)
+	// a closure was called and its frame pushed
+	Enter(fn *code.CompiledFunction, args []object.Object)
+	// fn returned result, Null for a bare return
+	Exit(fn *code.CompiledFunction, result object.Object)
+	SetGlobal(index int, value object.Object)
+}
+
+func (vm *VM) SetTracer(t Tracer) {
+	vm.tracer = t
+}
+
+/*
+writes one line per event, calls indent what runs inside them:
+
+	0022  OpCall 2                       sp=3
+	-> add(1, 2)
+	  0000  OpGetLocal 0                   sp=4
+	  ...
+	<- add = 3
+	0024  OpSetGlobal 2                  sp=1
+	global 2 = 3
+*/
+type LogTracer struct {
+	w     io.Writer
+	depth int
+}
+
+func NewLogTracer(w io.Writer) *LogTracer {
+	return &LogTracer{w: w}
+}
+
+func (t *LogTracer) Dispatch(fn *code.CompiledFunction, ip int, op code.Opcode, operands []int, stackDepth int) {
+	parts := []string{opcodeName(op)}
+	for _, operand := range operands {
+		parts = append(parts, fmt.Sprint(operand))
+	}
+	t.printf("%-36s sp=%d", fmt.Sprintf("%04d  %s", ip, strings.Join(parts, " ")), stackDepth)
+}
+
+func (t *LogTracer) Enter(fn *code.CompiledFunction, args []object.Object) {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		values[i] = arg.Inspect()
+	}
+	t.printf("-> %s(%s)", fn.DisplayName(), strings.Join(values, ", "))
+	t.depth++
+}
+
+func (t *LogTracer) Exit(fn *code.CompiledFunction, result object.Object) {
+	t.depth--
+	t.printf("<- %s = %s", fn.DisplayName(), result.Inspect())
+}
+
+func (t *LogTracer) SetGlobal(index int, value object.Object) {
+	t.printf("global %d = %s", index, value.Inspect())
+}
+
+func (t *LogTracer) printf(format string, a ...interface{}) {
+	fmt.Fprintf(t.w, "%s%s\n", strings.Repeat("  ", t.depth), fmt.Sprintf(format, a...))
+}
+
+func opcodeName(op code.Opcode) string {
+	if def, err := code.Lookup(byte(op)); err == nil {
+		return def.Name
+	}
+	return fmt.Sprintf("opcode %d", op)
+}
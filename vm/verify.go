@@ -0,0 +1,289 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"monkey-c/code"
+	"monkey-c/compiler"
+	"monkey-c/disasm"
+	"monkey-i/object"
+	"strings"
+)
+
+// one problem found by Verify, Offset is the instruction it concerns
+type Diagnostic struct {
+	Function string
+	Offset   int
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s %04d: %s", d.Function, d.Offset, d.Message)
+}
+
+type VerifyError []Diagnostic
+
+func (e VerifyError) Error() string {
+	lines := make([]string, len(e))
+	for i, d := range e {
+		lines[i] = d.String()
+	}
+	return "bytecode verification failed:\n  " + strings.Join(lines, "\n  ")
+}
+
+/*
+checks bytecode before it is run, so a bad artifact is rejected up front
+instead of faulting halfway through:
+  - every instruction decodes to a known opcode with all its operand bytes
+  - constant, global, local, free and builtin indexes are in range
+  - OpClosure points at a CompiledFunction, only functions return
+  - jumps land on instruction boundaries
+  - every instruction is reached with one stack depth, which never drops
+    below what it pops, and functions cannot run off their end
+
+globals are checked against the default GlobalsSize, bytecode meant for a
+VM with another Config goes through VerifyWith
+*/
+func Verify(b *compiler.Bytecode) error {
+	return VerifyWith(b, DefaultConfig())
+}
+
+// Verify for a VM created with config -> global indexes must fit its GlobalsSize
+func VerifyWith(b *compiler.Bytecode, config Config) error {
+	config = config.withDefaults()
+	v := &verifier{constants: b.Constants, globalsSize: config.GlobalsSize, freeCounts: map[int]int{}}
+
+	// free slots only exist as far as every OpClosure creating the function fills them
+	v.collectFreeCounts(b.Instructions)
+	for _, constant := range b.Constants {
+		if fn, ok := constant.(*code.CompiledFunction); ok {
+			v.collectFreeCounts(fn.Instructions)
+		}
+	}
+
+	v.verifyFunction("<main>", -1, &code.CompiledFunction{Instructions: b.Instructions})
+	for i, constant := range b.Constants {
+		if fn, ok := constant.(*code.CompiledFunction); ok {
+			v.verifyFunction(fmt.Sprintf("constant %d (%s)", i, fn.DisplayName()), i, fn)
+		}
+	}
+
+	if len(v.diagnostics) > 0 {
+		return v.diagnostics
+	}
+	return nil
+}
+
+type verifier struct {
+	constants   []object.Object
+	globalsSize int
+	freeCounts  map[int]int
+	diagnostics VerifyError
+
+	function string
+	index    int // constant index of the function, -1 for main
+	fn       *code.CompiledFunction
+}
+
+func (v *verifier) errorf(offset int, format string, a ...interface{}) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{Function: v.function, Offset: offset, Message: fmt.Sprintf(format, a...)})
+}
+
+func (v *verifier) collectFreeCounts(ins code.Instructions) {
+	decoded, err := disasm.Decode(ins)
+	if err != nil {
+		return // reported when the function itself is verified
+	}
+
+	for _, in := range decoded {
+		if in.Op != code.OpClosure {
+			continue
+		}
+		if n, ok := v.freeCounts[in.Operands[0]]; !ok || in.Operands[1] < n {
+			v.freeCounts[in.Operands[0]] = in.Operands[1]
+		}
+	}
+}
+
+func (v *verifier) verifyFunction(name string, index int, fn *code.CompiledFunction) {
+	v.function, v.index, v.fn = name, index, fn
+
+	if fn.NumParameters > fn.NumLocals {
+		v.errorf(0, "%d parameters but only %d locals", fn.NumParameters, fn.NumLocals)
+	}
+
+	decoded, err := disasm.Decode(fn.Instructions)
+	if err != nil {
+		var decodeErr *disasm.DecodeError
+		if errors.As(err, &decodeErr) {
+			v.errorf(decodeErr.Offset, "%s", decodeErr.Message)
+		} else {
+			v.errorf(0, "%s", err)
+		}
+		return
+	}
+
+	at := make(map[int]int, len(decoded)) // offset -> index into decoded
+	for i, in := range decoded {
+		at[in.Offset] = i
+	}
+
+	ok := true
+	for _, in := range decoded {
+		ok = v.checkOperands(in, at, len(fn.Instructions)) && ok
+	}
+	if ok {
+		v.checkStack(decoded, at)
+	}
+}
+
+func (v *verifier) checkOperands(in disasm.Instruction, at map[int]int, length int) bool {
+	ok := true
+	fail := func(format string, a ...interface{}) {
+		v.errorf(in.Offset, in.Def.Name+" "+format, a...)
+		ok = false
+	}
+
+	switch in.Op {
+	case code.OpConstant, code.OpClosure:
+		index := in.Operands[0]
+		if index >= len(v.constants) {
+			fail("constant %d out of range, pool has %d", index, len(v.constants))
+			break
+		}
+		if _, isFn := v.constants[index].(*code.CompiledFunction); in.Op == code.OpClosure && !isFn {
+			fail("constant %d is %s, not a function", index, v.constants[index].Type())
+		}
+
+	case code.OpReturnValue, code.OpReturn:
+		// main has no caller to return to, the VM would fail on it
+		if v.index < 0 {
+			fail("outside of a function")
+		}
+
+	case code.OpJump, code.OpJumpNotTruthy, code.OpJumpTruthy:
+		if _, isStart := at[in.Operands[0]]; !isStart && in.Operands[0] != length {
+			fail("target %04d is not an instruction boundary", in.Operands[0])
+		}
+
+	case code.OpGetGlobal, code.OpSetGlobal:
+		if in.Operands[0] >= v.globalsSize {
+			fail("global %d out of range, limit is %d", in.Operands[0], v.globalsSize)
+		}
+
+	case code.OpGetLocal, code.OpSetLocal, code.OpGetBoxedLocal, code.OpSetBoxedLocal, code.OpLoadLocalCell:
+		if in.Operands[0] >= v.fn.NumLocals {
+			fail("local %d out of range, function has %d", in.Operands[0], v.fn.NumLocals)
+		}
+
+	case code.OpGetFree, code.OpSetFree, code.OpLoadFreeCell:
+		if n := v.freeCounts[v.index]; in.Operands[0] >= n {
+			fail("free variable %d out of range, closures capture %d", in.Operands[0], n)
+		}
+
+	case code.OpGetBuiltin:
+		if in.Operands[0] >= len(code.Builtins) {
+			fail("builtin %d out of range, there are %d", in.Operands[0], len(code.Builtins))
+		}
+	}
+	return ok
+}
+
+// values popped and pushed by an instruction
+func stackEffect(in disasm.Instruction) (pops, pushes int) {
+	switch in.Op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull,
+		code.OpGetGlobal, code.OpGetLocal, code.OpGetFree, code.OpGetBuiltin,
+		code.OpGetBoxedLocal, code.OpLoadLocalCell, code.OpLoadFreeCell, code.OpCurrentClosure:
+		return 0, 1
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanEqual, code.OpIndex:
+		return 2, 1
+	case code.OpMinus, code.OpBang:
+		return 1, 1
+	case code.OpPop, code.OpJumpNotTruthy, code.OpJumpTruthy, code.OpReturnValue,
+		code.OpSetGlobal, code.OpSetLocal, code.OpSetFree, code.OpSetBoxedLocal:
+		return 1, 0
+	case code.OpArray, code.OpHash:
+		return in.Operands[0], 1
+	case code.OpSetIndex:
+		return 3, 1
+	case code.OpDup2:
+		return 2, 4
+	case code.OpCall:
+		return in.Operands[0] + 1, 1
+	case code.OpClosure:
+		return in.Operands[1], 1
+	}
+	return 0, 0
+}
+
+/*
+walks every path from the entry recording the depth each instruction is
+reached with -> two paths meeting with different depths, or an instruction
+popping more than is there, means the stack would go out of balance
+*/
+func (v *verifier) checkStack(decoded []disasm.Instruction, at map[int]int) {
+	depths := make([]int, len(decoded))
+	for i := range depths {
+		depths[i] = -1
+	}
+	length := len(v.fn.Instructions)
+
+	worklist := []int{}
+	reach := func(from disasm.Instruction, target, depth int) {
+		if target == length {
+			if v.index >= 0 {
+				v.errorf(from.Offset, "%s runs off the end of the function", from.Def.Name)
+			}
+			return
+		}
+
+		i := at[target]
+		switch {
+		case depths[i] < 0:
+			depths[i] = depth
+			worklist = append(worklist, i)
+		case depths[i] != depth:
+			v.errorf(target, "stack depth %d on one path, %d on another", depths[i], depth)
+		}
+	}
+
+	if len(decoded) == 0 {
+		if v.index >= 0 {
+			v.errorf(0, "empty function body")
+		}
+		return
+	}
+	depths[0] = 0
+	worklist = append(worklist, 0)
+
+	for len(worklist) > 0 {
+		i := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+		in := decoded[i]
+
+		pops, pushes := stackEffect(in)
+		if depths[i] < pops {
+			v.errorf(in.Offset, "%s pops %d values, stack holds %d", in.Def.Name, pops, depths[i])
+			continue
+		}
+		depth := depths[i] - pops + pushes
+		next := length
+		if i+1 < len(decoded) {
+			next = decoded[i+1].Offset
+		}
+
+		switch in.Op {
+		case code.OpReturnValue, code.OpReturn:
+			// leaves the function, nothing follows on this path
+		case code.OpJump:
+			reach(in, in.Operands[0], depth)
+		case code.OpJumpNotTruthy, code.OpJumpTruthy:
+			reach(in, in.Operands[0], depth)
+			reach(in, next, depth)
+		default:
+			reach(in, next, depth)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package vm
+
+import (
+	"monkey-c/asm"
+	"monkey-c/code"
+	"monkey-c/compiler"
+	"monkey-i/object"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		expected []string
+	}{
+		{"constant out of range", "OpConstant 3\nOpPop", []string{"<main> 0000: OpConstant constant 3 out of range, pool has 0"}},
+		{
+			"closure over non-function",
+			".const int 1\nOpClosure 0 0\nOpPop",
+			[]string{"<main> 0000: OpClosure constant 0 is INTEGER, not a function"},
+		},
+		{"global out of range", "OpGetGlobal 4000\nOpPop", []string{"<main> 0000: OpGetGlobal global 4000 out of range, limit is 2048"}},
+		{"local in main", "OpGetLocal 0\nOpPop", []string{"<main> 0000: OpGetLocal local 0 out of range, function has 0"}},
+		{"builtin out of range", "OpGetBuiltin 99\nOpPop", []string{"<main> 0000: OpGetBuiltin builtin 99 out of range, there are 6"}},
+		{
+			"local beyond NumLocals",
+			"OpClosure 0 0\nOpPop\n.func \"f\" params=1 locals=1\nOpGetLocal 1\nOpReturnValue",
+			[]string{"constant 0 (f) 0000: OpGetLocal local 1 out of range, function has 1"},
+		},
+		{
+			"free beyond captured",
+			"OpNull\nOpClosure 0 1\nOpPop\n.func \"f\"\nOpGetFree 1\nOpReturnValue",
+			[]string{"constant 0 (f) 0000: OpGetFree free variable 1 out of range, closures capture 1"},
+		},
+		{"return value in main", "OpNull\nOpReturnValue", []string{"<main> 0001: OpReturnValue outside of a function"}},
+		{"return in main", "OpReturn", []string{"<main> 0000: OpReturn outside of a function"}},
+		{"pop on empty stack", "OpPop", []string{"<main> 0000: OpPop pops 1 values, stack holds 0"}},
+		{"call without callee", "OpCall 0\nOpPop", []string{"<main> 0000: OpCall pops 1 values, stack holds 0"}},
+		{
+			"unbalanced branches",
+			"OpTrue\nOpJumpNotTruthy else\nOpTrue\nOpTrue\nOpJump end\nelse:\nOpNull\nend:\nOpPop",
+			[]string{"<main> 0010: stack depth 2 on one path, 1 on another"},
+		},
+		{
+			"running off a function",
+			"OpClosure 0 0\nOpPop\n.func \"f\"\nOpNull\nOpPop",
+			[]string{"constant 0 (f) 0001: OpPop runs off the end of the function"},
+		},
+		{
+			"parameters exceed locals",
+			"OpClosure 0 0\nOpPop\n.func \"f\" params=2 locals=1\nOpReturn",
+			[]string{"constant 0 (f) 0000: 2 parameters but only 1 locals"},
+		},
+		{
+			"several problems",
+			"OpConstant 1\nOpGetLocal 2\nOpPop",
+			[]string{
+				"<main> 0000: OpConstant constant 1 out of range, pool has 0",
+				"<main> 0003: OpGetLocal local 2 out of range, function has 0",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		bytecode, err := asm.Assemble(tt.src)
+		if err != nil {
+			t.Fatalf("%s: assemble error: %s", tt.name, err)
+		}
+		testVerifyError(t, tt.name, Verify(bytecode), tt.expected)
+	}
+}
+
+func TestVerifyWithConfig(t *testing.T) {
+	bytecode, err := asm.Assemble("OpNull\nOpSetGlobal 3000\nOpGetGlobal 100\nOpPop")
+	if err != nil {
+		t.Fatalf("assemble error: %s", err)
+	}
+
+	testVerifyError(t, "default globals", Verify(bytecode), []string{
+		"<main> 0001: OpSetGlobal global 3000 out of range, limit is 2048",
+	})
+	if err := VerifyWith(bytecode, Config{GlobalsSize: 4096}); err != nil {
+		t.Errorf("more globals: unexpected error %s", err)
+	}
+	testVerifyError(t, "fewer globals", VerifyWith(bytecode, Config{GlobalsSize: 64}), []string{
+		"<main> 0001: OpSetGlobal global 3000 out of range, limit is 64",
+		"<main> 0004: OpGetGlobal global 100 out of range, limit is 64",
+	})
+
+	// what passes runs on a VM with the same config
+	if err := New(bytecode, Config{GlobalsSize: 4096}).Run(); err != nil {
+		t.Errorf("vm error: %s", err)
+	}
+}
+
+func TestVerifyMalformedStreams(t *testing.T) {
+	tests := []struct {
+		name     string
+		bytecode *compiler.Bytecode
+		expected []string
+	}{
+		{
+			"unknown opcode",
+			&compiler.Bytecode{Instructions: code.Instructions{byte(code.OpNull), 0xfa}},
+			[]string{"<main> 0001: opcode 250 undefined"},
+		},
+		{
+			"truncated operand",
+			&compiler.Bytecode{Instructions: append(code.MustMake(code.OpNull), code.MustMake(code.OpSetGlobal, 0)[:2]...)},
+			[]string{"<main> 0001: truncated OpSetGlobal, want 2 operand bytes, have 1"},
+		},
+		{
+			"jump into an instruction",
+			&compiler.Bytecode{
+				Instructions: append(code.MustMake(code.OpJump, 4), code.MustMake(code.OpConstant, 0)...),
+				Constants:    []object.Object{&object.Integer{Value: 1}},
+			},
+			[]string{"<main> 0000: OpJump target 0004 is not an instruction boundary"},
+		},
+		{
+			"malformed function body",
+			&compiler.Bytecode{Constants: []object.Object{&code.CompiledFunction{Name: "f", Instructions: code.Instructions{0xfa}}}},
+			[]string{"constant 0 (f) 0000: opcode 250 undefined"},
+		},
+	}
+
+	for _, tt := range tests {
+		testVerifyError(t, tt.name, Verify(tt.bytecode), tt.expected)
+	}
+}
+
+func testVerifyError(t *testing.T, name string, err error, expected []string) {
+	t.Helper()
+
+	verifyErr, ok := err.(VerifyError)
+	if !ok {
+		t.Errorf("%s: error is not VerifyError. got=%T (%v)", name, err, err)
+		return
+	}
+	if len(verifyErr) != len(expected) {
+		t.Errorf("%s: wrong number of diagnostics. want=%d, got=%d\n%s", name, len(expected), len(verifyErr), verifyErr)
+		return
+	}
+	for i, diagnostic := range verifyErr {
+		if diagnostic.String() != expected[i] {
+			t.Errorf("%s: wrong diagnostic. want=%q, got=%q", name, expected[i], diagnostic)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"monkey-c/code"
 	"monkey-c/compiler"
 	"monkey-i/object"
 )
 
+// defaults of Config
 const (
 	StackLim             = 2048
 	GlobalsSize          = 2048
@@ -35,11 +38,19 @@ type VM struct {
 	globals           []object.Object
 	activationRecords []*ActivationRecord
 	recordPointer     int
+	operands          [2]int            // scratch for the decoded operands of the current instruction
+	builtins          []*object.Builtin // code.Builtins with puts writing to config.Stdout
+
+	config       Config
+	instructions int64 // executed so far, counted against config.MaxInstructions
+	heapObjects  int
+	preempt      bool // a backward jump or call ran -> RunContext looks at its context
+	tracer       Tracer
 }
 
 func (vm *VM) push(o object.Object) error {
-	if vm.stackPointer >= StackLim {
-		return fmt.Errorf("stack overflow")
+	if vm.stackPointer >= len(vm.stack) {
+		return runtimeErrorf(StackOverflow, "stack overflow")
 	}
 	vm.stack[vm.stackPointer] = o
 	vm.stackPointer++
@@ -48,7 +59,7 @@ func (vm *VM) push(o object.Object) error {
 
 func (vm *VM) pop() object.Object {
 	if vm.stackPointer == 0 {
-		panic("stack is empty !!")
+		panic(runtimeErrorf(StackUnderflow, "stack is empty"))
 	}
 
 	o := vm.stack[vm.stackPointer-1]
@@ -82,9 +93,13 @@ func (vm *VM) currentRecord() *ActivationRecord {
 	return vm.activationRecords[vm.recordPointer-1]
 }
 
-func (vm *VM) pushRecord(ar *ActivationRecord) {
+func (vm *VM) pushRecord(ar *ActivationRecord) error {
+	if vm.recordPointer >= len(vm.activationRecords) {
+		return runtimeErrorf(StackOverflow, "stack overflow: more than %d nested calls", len(vm.activationRecords))
+	}
 	vm.activationRecords[vm.recordPointer] = ar
 	vm.recordPointer++
+	return nil
 }
 
 func (vm *VM) popRecord() *ActivationRecord {
@@ -92,225 +107,478 @@ func (vm *VM) popRecord() *ActivationRecord {
 	return vm.activationRecords[vm.recordPointer]
 }
 
-func New(bytecode *compiler.Bytecode) *VM {
+func New(bytecode *compiler.Bytecode, config Config) *VM {
+	config = config.withDefaults()
 
-	mainFn := &code.CompiledFunction{Instructions: bytecode.Instructions}
+	mainFn := &code.CompiledFunction{Instructions: bytecode.Instructions, Name: "<main>", Positions: bytecode.Positions}
 	mainClosure := &code.Closure{Fn: mainFn}
 	mainRecord := NewRecord(mainClosure, 0)
 	vm := &VM{
 		constants:         bytecode.Constants,
-		stack:             make([]object.Object, StackLim),
+		stack:             make([]object.Object, config.StackSize),
 		stackPointer:      0,
-		globals:           make([]object.Object, GlobalsSize),
-		activationRecords: make([]*ActivationRecord, ActivationRecordSize),
+		globals:           make([]object.Object, config.GlobalsSize),
+		activationRecords: make([]*ActivationRecord, config.MaxFrames),
 		recordPointer:     0,
+		config:            config,
+		builtins:          code.BuiltinsWritingTo(config.Stdout),
 	}
 	vm.pushRecord(mainRecord)
 	return vm
 }
 
-func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
-	vm := New(bytecode)
+// globals live on in s between runs, its length is the globals limit
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, config Config, s []object.Object) *VM {
+	vm := New(bytecode, config)
 	vm.globals = s
 	return vm
 }
 
 func (vm *VM) Run() error {
-	var ip int
-	var ins code.Instructions
-	var op code.Opcode
+	return vm.RunContext(context.Background())
+}
 
-	for vm.currentRecord().instructionPointer < len(vm.currentRecord().Instructions())-1 {
-		vm.currentRecord().instructionPointer++
-		ip = vm.currentRecord().instructionPointer
-		ins = vm.currentRecord().Instructions()
+/*
+runs until the program ends or ctx is done, which gives back ctx.Err().
+only backward jumps and calls can keep a program running for long, so the
+context is looked at after those alone. a cancelled VM stops between two
+instructions -> its stack, globals and Traceback stay as they were and a
+later Run carries on from there
+*/
+func (vm *VM) RunContext(ctx context.Context) error {
+	_, err := vm.run(ctx, nil)
+	return err
+}
 
-		op = code.Opcode(ins[ip])
-		switch op {
-		case code.OpConstant:
-			constIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentRecord().instructionPointer += 2
+/*
+runs until stop holds after an instruction, reporting whether it did or
+the program ended first -> at least one instruction runs, so resuming
+from a stop that still holds moves on
+*/
+func (vm *VM) RunUntil(stop func(vm *VM) bool) (bool, error) {
+	return vm.run(context.Background(), stop)
+}
 
-			if err := vm.push(vm.constants[constIndex]); err != nil {
-				return err
-			}
+var ErrHalted = errors.New("program has finished")
 
-		case code.OpNull:
-			if err := vm.push(Null); err != nil {
-				return err
-			}
+// executes exactly one instruction, a call or return moves to the other function
+func (vm *VM) Step() error {
+	if vm.Halted() {
+		return ErrHalted
+	}
+	return vm.step()
+}
 
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
-			if err := vm.executeBinaryOperation(op); err != nil {
-				return err
-			}
+func (vm *VM) run(ctx context.Context, stop func(vm *VM) bool) (bool, error) {
+	done := ctx.Done()
+	for !vm.Halted() {
+		if err := vm.step(); err != nil {
+			return false, err
+		}
 
-		case code.OpTrue:
-			if err := vm.push(True); err != nil {
-				return err
+		if vm.preempt && done != nil {
+			vm.preempt = false
+			select {
+			case <-done:
+				return false, ctx.Err()
+			default:
 			}
+		}
+		if stop != nil && stop(vm) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
 
-		case code.OpFalse:
-			if err := vm.push(False); err != nil {
-				return err
-			}
+func (vm *VM) Halted() bool {
+	record := vm.currentRecord()
+	return record.instructionPointer >= len(record.Instructions())-1
+}
 
-		case code.OpBang:
-			if err := vm.executeBangOperator(); err != nil {
-				return err
-			}
+// the record of the function running now, its IP is the next instruction
+func (vm *VM) CurrentRecord() *ActivationRecord {
+	return vm.currentRecord()
+}
 
-		case code.OpMinus:
-			if err := vm.executeNumberNegation(); err != nil {
-				return err
-			}
+// frames active now, 1 while only main runs
+func (vm *VM) Depth() int {
+	return vm.recordPointer
+}
 
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanEqual:
-			if err := vm.executeComp(op); err != nil {
-				return err
-			}
+// the global slots themselves, by index
+func (vm *VM) Globals() []object.Object {
+	return vm.globals
+}
 
-		case code.OpPop:
-			vm.pop()
+// the operand stack bottom first, locals of every frame included
+func (vm *VM) Stack() []object.Object {
+	return append([]object.Object{}, vm.stack[:vm.stackPointer]...)
+}
 
-		case code.OpJump:
-			pos := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentRecord().instructionPointer = pos - 1
+/*
+executes the next instruction of the current record and is the recover
+boundary -> any fault, returned or panicked, leaves as a *RuntimeError
+pinned to the instruction that raised it
+*/
+func (vm *VM) step() (err error) {
+	record := vm.currentRecord()
+	record.instructionPointer++
+	ip := record.instructionPointer
+	record.currentOp = ip
 
-		case code.OpJumpNotTruthy:
-			pos := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentRecord().instructionPointer += 2
+	var op code.Opcode
+	defer func() {
+		if r := recover(); r != nil {
+			err = vm.locateError(panicToRuntimeError(r), op, ip, record)
+		}
+	}()
 
-			condition := vm.pop()
-			if !isTruthy(condition) {
-				vm.currentRecord().instructionPointer = pos - 1
-			}
+	ins := record.Instructions()
+	if ip < 0 || ip >= len(ins) {
+		return vm.locateError(runtimeErrorf(InternalError, "instruction pointer %04d outside of %d bytes of instructions", ip, len(ins)), op, ip, record)
+	}
+	op = code.Opcode(ins[ip])
 
-		case code.OpSetGlobal:
-			gIdx := code.ReadUint16(ins[ip+1:])
-			vm.currentRecord().instructionPointer += 2
-			vm.globals[gIdx] = vm.pop()
+	vm.instructions++
+	if vm.config.MaxInstructions > 0 && vm.instructions > vm.config.MaxInstructions {
+		return vm.locateError(runtimeErrorf(InstructionLimit, "instruction limit of %d exceeded", vm.config.MaxInstructions), op, ip, record)
+	}
 
-		case code.OpGetGlobal:
-			gIdx := code.ReadUint16(ins[ip+1:])
-			vm.currentRecord().instructionPointer += 2
-			if err := vm.push(vm.globals[gIdx]); err != nil {
-				return err
-			}
+	op, operands := vm.decode(record, ins, ip)
+	if vm.tracer != nil {
+		vm.tracer.Dispatch(record.cl.Fn, ip, op, operands, vm.stackPointer)
+	}
+	if err := vm.execute(op, operands); err != nil {
+		return vm.locateError(err, op, ip, record)
+	}
+	return nil
+}
 
-		case code.OpSetLocal:
-			localIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentRecord().instructionPointer += 1
-			record := vm.currentRecord()
-			vm.stack[record.basePointer+int(localIndex)] = vm.pop()
+var operandWidths, wideOperandWidths [256][]int
 
-		case code.OpGetLocal:
-			localIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentRecord().instructionPointer += 1
-			record := vm.currentRecord()
+func init() {
+	for op := 0; op < 256; op++ {
+		if def, err := code.Lookup(byte(op)); err == nil {
+			operandWidths[op] = def.OperandWidths
+		}
+		if def, err := code.LookupWide(byte(op)); err == nil {
+			wideOperandWidths[op] = def.OperandWidths
+		}
+	}
+}
 
-			if err := vm.push(vm.stack[record.basePointer+int(localIndex)]); err != nil {
-				return err
-			}
+/*
+reads the operands of the instruction at ip, following an OpWide prefix,
+and leaves the instruction pointer on its last byte -> jumps then only
+need to point it just before their target
+*/
+func (vm *VM) decode(record *ActivationRecord, ins code.Instructions, ip int) (code.Opcode, []int) {
+	op := code.Opcode(ins[ip])
+	widths := operandWidths[op]
+	offset := ip + 1
+
+	if op == code.OpWide {
+		op = code.Opcode(ins[offset])
+		widths = wideOperandWidths[op]
+		offset++
+		if widths == nil {
+			panic(runtimeErrorf(InternalError, "opcode %d has no wide form", op))
+		}
+	}
 
-		case code.OpGetFree:
-			freeIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentRecord().instructionPointer += 1
-			currentClosure := vm.currentRecord().cl
-			if err := vm.push(currentClosure.Free[freeIndex]); err != nil {
-				return err
-			}
+	operands := vm.operands[:len(widths)]
+	for i, width := range widths {
+		switch width {
+		case 1:
+			operands[i] = int(ins[offset])
+		case 2:
+			operands[i] = int(code.ReadUint16(ins[offset:]))
+		case 4:
+			operands[i] = int(code.ReadUint32(ins[offset:]))
+		}
+		offset += width
+	}
 
-		case code.OpArray:
-			numElems := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentRecord().instructionPointer += 2
+	record.instructionPointer = offset - 1
+	return op, operands
+}
 
-			arr := vm.buildArray(vm.stackPointer-numElems, vm.stackPointer)
-			vm.stackPointer = vm.stackPointer - numElems
-			if err := vm.push(arr); err != nil {
-				return err
-			}
+func (vm *VM) execute(op code.Opcode, operands []int) error {
+	switch op {
+	case code.OpConstant:
+		constIndex := operands[0]
+
+		if err := vm.push(vm.constants[constIndex]); err != nil {
+			return err
+		}
 
-		case code.OpHash:
-			numElems := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentRecord().instructionPointer += 2
+	case code.OpNull:
+		if err := vm.push(Null); err != nil {
+			return err
+		}
 
-			hash, err := vm.buildHash(vm.stackPointer-numElems, vm.stackPointer)
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		if err := vm.executeBinaryOperation(op); err != nil {
+			return err
+		}
 
-			if err != nil {
-				return err
-			}
+	case code.OpTrue:
+		if err := vm.push(True); err != nil {
+			return err
+		}
 
-			vm.stackPointer = vm.stackPointer - numElems
+	case code.OpFalse:
+		if err := vm.push(False); err != nil {
+			return err
+		}
 
-			if err = vm.push(hash); err != nil {
-				return err
-			}
+	case code.OpBang:
+		if err := vm.executeBangOperator(); err != nil {
+			return err
+		}
 
-		case code.OpIndex:
-			index := vm.pop()
-			left := vm.pop()
-			if err := vm.executeIndexExpression(left, index); err != nil {
-				return err
-			}
+	case code.OpMinus:
+		if err := vm.executeNumberNegation(); err != nil {
+			return err
+		}
 
-		case code.OpCall:
-			numArgs := code.ReadUint8(ins[ip+1:])
-			vm.currentRecord().instructionPointer += 1
+	case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanEqual:
+		if err := vm.executeComp(op); err != nil {
+			return err
+		}
 
-			cl, ok := vm.stack[vm.stackPointer-1-int(numArgs)].(*code.Closure)
-			if !ok {
-				return fmt.Errorf("calling non-function")
-			}
+	case code.OpPop:
+		vm.pop()
 
-			if numArgs != uint8(cl.Fn.NumParameters) {
-				return fmt.Errorf("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
-			}
+	case code.OpJump:
+		pos := operands[0]
+		vm.jump(pos)
 
-			ar := NewRecord(cl, vm.stackPointer-int(numArgs))
-			vm.pushRecord(ar)
-			vm.stackPointer = ar.basePointer + cl.Fn.NumLocals
+	case code.OpJumpNotTruthy:
+		pos := operands[0]
 
-		case code.OpClosure:
-			constIndex := code.ReadUint16(ins[ip+1:])
-			freeVarSize := code.ReadUint8(ins[ip+3:])
-			vm.currentRecord().instructionPointer += 3
-			err := vm.pushClosure(int(constIndex), int(freeVarSize))
-			if err != nil {
-				return err
-			}
+		condition := vm.pop()
+		if !isTruthy(condition) {
+			vm.jump(pos)
+		}
 
-		case code.OpReturnValue:
-			returnValue := vm.pop()
-			record := vm.popRecord()
-			vm.stackPointer = record.basePointer - 1
-			// vm.pop() // removing the function from the global stack
+	case code.OpJumpTruthy:
+		pos := operands[0]
 
-			if err := vm.push(returnValue); err != nil {
-				return err
-			}
+		condition := vm.pop()
+		if isTruthy(condition) {
+			vm.jump(pos)
+		}
 
-		case code.OpReturn:
-			record := vm.popRecord()
-			vm.stackPointer = record.basePointer - 1
-			// vm.pop() // removing the function from the global stack
-			err := vm.push(Null)
-			if err != nil {
-				return err
-			}
+	case code.OpSetGlobal:
+		gIdx := operands[0]
+		if gIdx >= len(vm.globals) {
+			return runtimeErrorf(GlobalsExhausted, "global %d out of range, limit is %d", gIdx, len(vm.globals))
+		}
+		vm.globals[gIdx] = vm.pop()
+		if vm.tracer != nil {
+			vm.tracer.SetGlobal(gIdx, vm.globals[gIdx])
+		}
 
-		case code.OpCurrentClosure:
-			currentClosure := vm.currentRecord().cl
-			err := vm.push(currentClosure)
-			if err != nil {
-				return err
-			}
+	case code.OpGetGlobal:
+		gIdx := operands[0]
+		if gIdx >= len(vm.globals) {
+			return runtimeErrorf(GlobalsExhausted, "global %d out of range, limit is %d", gIdx, len(vm.globals))
+		}
+		if err := vm.push(vm.globals[gIdx]); err != nil {
+			return err
+		}
+
+	case code.OpSetLocal:
+		localIndex := operands[0]
+		record := vm.currentRecord()
+		vm.stack[record.basePointer+int(localIndex)] = vm.pop()
+
+	case code.OpGetLocal:
+		localIndex := operands[0]
+		record := vm.currentRecord()
+
+		if err := vm.push(vm.stack[record.basePointer+int(localIndex)]); err != nil {
+			return err
+		}
+
+	case code.OpGetFree:
+		freeIndex := operands[0]
+		cell := vm.currentRecord().cl.Free[freeIndex].(*code.Cell)
+		if err := vm.push(cell.Value); err != nil {
+			return err
+		}
+
+	case code.OpSetFree:
+		freeIndex := operands[0]
+		cell := vm.currentRecord().cl.Free[freeIndex].(*code.Cell)
+		cell.Value = vm.pop()
+
+	case code.OpGetBoxedLocal:
+		localIndex := operands[0]
+		record := vm.currentRecord()
+
+		value := vm.stack[record.basePointer+int(localIndex)]
+		if cell, ok := value.(*code.Cell); ok {
+			value = cell.Value
+		}
+		if err := vm.push(value); err != nil {
+			return err
+		}
+
+	case code.OpSetBoxedLocal:
+		localIndex := operands[0]
+		record := vm.currentRecord()
+
+		slot := record.basePointer + int(localIndex)
+		if cell, ok := vm.stack[slot].(*code.Cell); ok {
+			cell.Value = vm.pop()
+		} else {
+			vm.stack[slot] = vm.pop()
+		}
+
+	case code.OpLoadLocalCell:
+		localIndex := operands[0]
+		record := vm.currentRecord()
+
+		cell, err := vm.localCell(record.basePointer + int(localIndex))
+		if err != nil {
+			return err
+		}
+		if err := vm.push(cell); err != nil {
+			return err
+		}
+
+	case code.OpLoadFreeCell:
+		freeIndex := operands[0]
+		if err := vm.push(vm.currentRecord().cl.Free[freeIndex]); err != nil {
+			return err
+		}
+
+	case code.OpGetBuiltin:
+		builtinIndex := operands[0]
+
+		if err := vm.push(vm.builtins[builtinIndex]); err != nil {
+			return err
+		}
+
+	case code.OpArray:
+		numElems := operands[0]
+
+		if err := vm.allocate(); err != nil {
+			return err
+		}
+		arr := vm.buildArray(vm.stackPointer-numElems, vm.stackPointer)
+		vm.stackPointer = vm.stackPointer - numElems
+		if err := vm.push(arr); err != nil {
+			return err
+		}
+
+	case code.OpHash:
+		numElems := operands[0]
+
+		if err := vm.allocate(); err != nil {
+			return err
+		}
+		hash, err := vm.buildHash(vm.stackPointer-numElems, vm.stackPointer)
+
+		if err != nil {
+			return err
+		}
+
+		vm.stackPointer = vm.stackPointer - numElems
+
+		if err = vm.push(hash); err != nil {
+			return err
+		}
+
+	case code.OpIndex:
+		index := vm.pop()
+		left := vm.pop()
+		if err := vm.executeIndexExpression(left, index); err != nil {
+			return err
+		}
+
+	case code.OpSetIndex:
+		value := vm.pop()
+		index := vm.pop()
+		left := vm.pop()
+		if err := vm.executeSetIndex(left, index, value); err != nil {
+			return err
+		}
+
+	case code.OpDup2:
+		left, index := vm.stack[vm.stackPointer-2], vm.stack[vm.stackPointer-1]
+		if err := vm.push(left); err != nil {
+			return err
+		}
+		if err := vm.push(index); err != nil {
+			return err
+		}
+
+	case code.OpCall:
+		numArgs := operands[0]
+
+		if err := vm.executeCall(int(numArgs)); err != nil {
+			return err
+		}
+
+	case code.OpClosure:
+		err := vm.pushClosure(operands[0], operands[1])
+		if err != nil {
+			return err
+		}
+
+	case code.OpReturnValue:
+		if vm.recordPointer == 1 {
+			return runtimeErrorf(InvalidCall, "return outside of function")
+		}
+		returnValue := vm.pop()
+		record := vm.popRecord()
+		vm.stackPointer = record.basePointer - 1
+		// vm.pop() // removing the function from the global stack
+		if vm.tracer != nil {
+			vm.tracer.Exit(record.cl.Fn, returnValue)
 		}
 
+		if err := vm.push(returnValue); err != nil {
+			return err
+		}
+
+	case code.OpReturn:
+		if vm.recordPointer == 1 {
+			return runtimeErrorf(InvalidCall, "return outside of function")
+		}
+		record := vm.popRecord()
+		vm.stackPointer = record.basePointer - 1
+		// vm.pop() // removing the function from the global stack
+		if vm.tracer != nil {
+			vm.tracer.Exit(record.cl.Fn, Null)
+		}
+		err := vm.push(Null)
+		if err != nil {
+			return err
+		}
+
+	case code.OpCurrentClosure:
+		currentClosure := vm.currentRecord().cl
+		err := vm.push(currentClosure)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+func (vm *VM) jump(pos int) {
+	record := vm.currentRecord()
+	if pos <= record.currentOp {
+		vm.preempt = true
+	}
+	record.instructionPointer = pos - 1
+}
+
 func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 
 	right := vm.pop()
@@ -321,11 +589,13 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	switch {
 	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
 		return vm.executeBinaryIntegerOperation(op, left.(*object.Integer), right.(*object.Integer))
+	case isNumber(left) && isNumber(right):
+		return vm.executeBinaryFloatOperation(op, toFloat(left), toFloat(right))
 	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
 		return vm.executeBinaryStringOperation(op, left.(*object.String), right.(*object.String))
 	}
 
-	return fmt.Errorf("unsupported types for binary operation: %s %s", leftType, rightType)
+	return runtimeErrorf(TypeMismatch, "unsupported types for binary operation: %s %s", leftType, rightType)
 }
 
 func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right *object.Integer) error {
@@ -338,18 +608,68 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right *object.
 	case code.OpMul:
 		result = left.Value * right.Value
 	case code.OpDiv:
+		if right.Value == 0 {
+			return runtimeErrorf(DivisionByZero, "division by zero: %d / 0", left.Value)
+		}
 		result = left.Value / right.Value
 	default:
-		return fmt.Errorf("unknown integer operator: %d", op)
+		return runtimeErrorf(TypeMismatch, "unknown integer operator: %d", op)
 	}
 	return vm.push(&object.Integer{Value: result})
 }
 
+func (vm *VM) executeBinaryFloatOperation(op code.Opcode, left, right float64) error {
+	var result float64
+	switch op {
+	case code.OpAdd:
+		result = left + right
+	case code.OpSub:
+		result = left - right
+	case code.OpMul:
+		result = left * right
+	case code.OpDiv:
+		if right == 0 {
+			return runtimeErrorf(DivisionByZero, "division by zero: %g / 0", left)
+		}
+		result = left / right
+	default:
+		return runtimeErrorf(TypeMismatch, "unknown float operator: %d", op)
+	}
+	return vm.push(&code.Float{Value: result})
+}
+
+/*
+mixed integer/float operands are promoted to float,
+integer only operands keep integer semantics
+*/
+func isNumber(obj object.Object) bool {
+	switch obj.(type) {
+	case *object.Integer, *code.Float:
+		return true
+	default:
+		return false
+	}
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *code.Float:
+		return obj.Value
+	default:
+		return 0
+	}
+}
+
 func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right *object.String) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unknown string operator: %d", op)
+		return runtimeErrorf(TypeMismatch, "unknown string operator: %d", op)
 	}
 
+	if err := vm.allocate(); err != nil {
+		return err
+	}
 	return vm.push(&object.String{Value: left.Value + right.Value})
 }
 
@@ -359,9 +679,10 @@ func (vm *VM) executeComp(op code.Opcode) error {
 
 	if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ {
 		return vm.executeIntegerComparison(op, left.(*object.Integer), right.(*object.Integer))
+	} else if isNumber(left) && isNumber(right) {
+		return vm.executeFloatComparison(op, toFloat(left), toFloat(right))
 	} else if left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ {
-		return vm.push(nativeBoolToBooleanObject(left.(*object.String).Value == right.(*object.String).Value))
-
+		return vm.executeStringComparison(op, left.(*object.String), right.(*object.String))
 	}
 
 	switch op {
@@ -370,7 +691,7 @@ func (vm *VM) executeComp(op code.Opcode) error {
 	case code.OpNotEqual:
 		return vm.push(nativeBoolToBooleanObject(right != left))
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+		return runtimeErrorf(TypeMismatch, "unknown operator: %d (%s %s)", op, left.Type(), right.Type())
 	}
 }
 
@@ -388,7 +709,41 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left, right *object.Integ
 	case code.OpGreaterThanEqual:
 		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
 	default:
-		return fmt.Errorf("unknown operator: %d", op)
+		return runtimeErrorf(TypeMismatch, "unknown operator: %d", op)
+	}
+}
+
+/*
+the compiler keeps one constant per string literal, so two pooled strings
+with the same value are the same object -> comparing pointers is a fast
+path only. strings built at runtime (concatenation, builtins) are new
+objects, for them equality still comes down to comparing values
+*/
+func (vm *VM) executeStringComparison(op code.Opcode, left, right *object.String) error {
+	equal := left == right || left.Value == right.Value
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(equal))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(!equal))
+	default:
+		return runtimeErrorf(TypeMismatch, "unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+	}
+}
+
+func (vm *VM) executeFloatComparison(op code.Opcode, left, right float64) error {
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(right == left))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(right != left))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(left > right))
+	case code.OpGreaterThanEqual:
+		return vm.push(nativeBoolToBooleanObject(left >= right))
+	default:
+		return runtimeErrorf(TypeMismatch, "unknown operator: %d", op)
 	}
 }
 
@@ -415,12 +770,14 @@ func (vm *VM) executeBangOperator() error {
 func (vm *VM) executeNumberNegation() error {
 
 	operand := vm.pop()
-	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	switch operand := operand.(type) {
+	case *object.Integer:
+		return vm.push(&object.Integer{Value: -operand.Value})
+	case *code.Float:
+		return vm.push(&code.Float{Value: -operand.Value})
+	default:
+		return runtimeErrorf(TypeMismatch, "unsupported type for negation: %s", operand.Type())
 	}
-
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
 }
 
 func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
@@ -443,7 +800,7 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 		pair := object.HashPair{Key: key, Value: value}
 		hashKey, ok := key.(object.Hashable)
 		if !ok {
-			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+			return nil, runtimeErrorf(InvalidIndex, "unusable as hash key: %s", key.Type())
 		}
 		hashPair[hashKey.HashKey()] = pair
 	}
@@ -452,18 +809,23 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 
 func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	switch {
-	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+	case left.Type() == object.ARRAY_OBJ:
 		return vm.executeArrayIndex(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndex(left, index)
 	default:
-		return fmt.Errorf("index operator not supported: %s", left.Type())
+		return runtimeErrorf(InvalidIndex, "index operator not supported: %s", left.Type())
 	}
 }
 
 func (vm *VM) executeArrayIndex(array, index object.Object) error {
 	arrayObject := array.(*object.Array)
-	i := index.(*object.Integer).Value
+	idx, ok := index.(*object.Integer)
+	if !ok {
+		return runtimeErrorf(InvalidIndex, "array index must be INTEGER, got %s", index.Type())
+	}
+
+	i := idx.Value
 	max := int64(len(arrayObject.Elements) - 1)
 	if i < 0 || i > max {
 		return vm.push(Null)
@@ -475,7 +837,7 @@ func (vm *VM) executeHashIndex(hash, index object.Object) error {
 	hashObj := hash.(*object.Hash)
 	key, ok := index.(object.Hashable)
 	if !ok {
-		return fmt.Errorf("unusable as hash key: %s", index.Type())
+		return runtimeErrorf(InvalidIndex, "unusable as hash key: %s", index.Type())
 	}
 
 	pair, ok := hashObj.Pairs[key.HashKey()]
@@ -486,18 +848,152 @@ func (vm *VM) executeHashIndex(hash, index object.Object) error {
 
 }
 
+/*
+arrays and hashes are mutated in place, so every binding that
+shares the collection observes the write
+*/
+func (vm *VM) executeSetIndex(left, index, value object.Object) error {
+	switch left := left.(type) {
+	case *object.Array:
+		i, ok := index.(*object.Integer)
+		if !ok {
+			return runtimeErrorf(InvalidIndex, "array index must be INTEGER, got %s", index.Type())
+		}
+		if i.Value < 0 || i.Value >= int64(len(left.Elements)) {
+			return runtimeErrorf(InvalidIndex, "array index out of range: %d", i.Value)
+		}
+		left.Elements[i.Value] = value
+
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return runtimeErrorf(InvalidIndex, "unusable as hash key: %s", index.Type())
+		}
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: value}
+
+	default:
+		return runtimeErrorf(InvalidIndex, "index assignment not supported: %s", left.Type())
+	}
+
+	return vm.push(value)
+}
+
+func (vm *VM) executeCall(numArgs int) error {
+	vm.preempt = true
+	callee := vm.stack[vm.stackPointer-1-numArgs]
+	switch callee := callee.(type) {
+	case *code.Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	default:
+		return runtimeErrorf(InvalidCall, "calling non-function")
+	}
+}
+
+func (vm *VM) callClosure(cl *code.Closure, numArgs int) error {
+	if numArgs != cl.Fn.NumParameters {
+		return runtimeErrorf(InvalidCall, "wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	}
+
+	if vm.stackPointer-numArgs+cl.Fn.NumLocals >= len(vm.stack) {
+		return runtimeErrorf(StackOverflow, "stack overflow")
+	}
+
+	ar := NewRecord(cl, vm.stackPointer-numArgs)
+	if err := vm.pushRecord(ar); err != nil {
+		return err
+	}
+	if vm.tracer != nil {
+		vm.tracer.Enter(cl.Fn, vm.stack[ar.basePointer:vm.stackPointer])
+	}
+	vm.stackPointer = ar.basePointer + cl.Fn.NumLocals
+
+	// slots past the args may hold cells left behind by an earlier call,
+	// writing through them would leak into that call's closures
+	for i := ar.basePointer + numArgs; i < vm.stackPointer; i++ {
+		vm.stack[i] = nil
+	}
+	return nil
+}
+
+/*
+builtins run natively -> no activation record is pushed,
+the callee and its args are dropped and replaced by the result
+*/
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := vm.stack[vm.stackPointer-numArgs : vm.stackPointer]
+
+	result := builtin.Fn(args...)
+	vm.stackPointer = vm.stackPointer - numArgs - 1
+
+	switch result.(type) {
+	case *object.Array, *object.Hash, *object.String:
+		if err := vm.allocate(); err != nil {
+			return err
+		}
+	}
+
+	if result != nil {
+		return vm.push(result)
+	}
+	return vm.push(Null)
+}
+
+/*
+boxes a local slot on first capture -> later captures and the
+boxed get/set ops of the defining function share that cell
+*/
+func (vm *VM) localCell(slot int) (*code.Cell, error) {
+	if cell, ok := vm.stack[slot].(*code.Cell); ok {
+		return cell, nil
+	}
+
+	if err := vm.allocate(); err != nil {
+		return nil, err
+	}
+	cell := &code.Cell{Value: vm.stack[slot]}
+	vm.stack[slot] = cell
+	return cell, nil
+}
+
+/*
+counts one more object against config.MaxHeapObjects -> the count never
+goes down as nothing tells the VM what the collector frees, so the limit
+bounds everything a script allocates over its run
+*/
+func (vm *VM) allocate() error {
+	vm.heapObjects++
+	if vm.config.MaxHeapObjects > 0 && vm.heapObjects > vm.config.MaxHeapObjects {
+		return runtimeErrorf(HeapLimit, "heap limit of %d objects exceeded", vm.config.MaxHeapObjects)
+	}
+	return nil
+}
+
 func (vm *VM) pushClosure(constIndex, freeVarSize int) error {
 	constant := vm.constants[constIndex]
 	function, ok := constant.(*code.CompiledFunction)
 
 	if !ok {
-		return fmt.Errorf("not a function: %+v", constant)
+		return runtimeErrorf(InvalidCall, "not a function: %+v", constant)
 	}
 
+	if err := vm.allocate(); err != nil {
+		return err
+	}
 	free := make([]object.Object, freeVarSize)
 	for i := 0; i < freeVarSize; i++ {
-		free[i] = vm.stack[vm.stackPointer-freeVarSize+i]
+		value := vm.stack[vm.stackPointer-freeVarSize+i]
+		cell, ok := value.(*code.Cell)
+		if !ok {
+			if err := vm.allocate(); err != nil {
+				return err
+			}
+			cell = &code.Cell{Value: value}
+		}
+		free[i] = cell
 	}
+	vm.stackPointer = vm.stackPointer - freeVarSize
 
 	closure := &code.Closure{Fn: function, Free: free}
 	return vm.push(closure)
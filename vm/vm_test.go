@@ -1,13 +1,22 @@
 package vm
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
+	"monkey-c/asm"
+	"monkey-c/code"
 	"monkey-c/compiler"
+	"monkey-c/internal/asttest"
 	"monkey-i/ast"
 	"monkey-i/lexer"
 	"monkey-i/object"
 	"monkey-i/parser"
+	"strings"
 	"testing"
+	"time"
 )
 
 func parse(input string) *ast.Program {
@@ -27,6 +36,17 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*code.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+	}
+	return nil
+}
+
 func testBooleanObject(expected bool, actual object.Object) error {
 	result, ok := actual.(*object.Boolean)
 	if !ok {
@@ -57,36 +77,56 @@ type vmTestCase struct {
 	expected interface{}
 }
 
+// for syntax the parser cannot produce yet
+type vmProgramTestCase struct {
+	program  *ast.Program
+	expected interface{}
+}
+
 func runVmTests(t *testing.T, tests []vmTestCase) {
 	t.Helper()
 
 	for _, tt := range tests {
+		runVmTest(t, parse(tt.input), tt.expected)
+	}
+}
 
-		prog := parse(tt.input)
+func runVmProgramTests(t *testing.T, tests []vmProgramTestCase) {
+	t.Helper()
 
-		comp := compiler.New()
-		err := comp.Compile(prog)
-		if err != nil {
-			t.Fatalf("compiler error: %s", err)
-		}
+	for _, tt := range tests {
+		runVmTest(t, tt.program, tt.expected)
+	}
+}
 
-		byteCode := comp.Bytecode()
-		vm := New(byteCode)
-		fmt.Printf("Bytecode -> %v\n", byteCode.Instructions)
-		for i := range byteCode.Constants {
-			fmt.Printf("Bytecode const[%d] -> %v\n", i, byteCode.Constants[i])
-		}
+func runVmTest(t *testing.T, prog *ast.Program, expected interface{}) {
+	t.Helper()
 
-		err = vm.Run()
-		fmt.Println(vm.StackTrace())
-		if err != nil {
-			t.Fatalf("vm error: %s", err)
-		}
+	comp := compiler.New()
+	err := comp.Compile(prog)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
 
-		stackElem := vm.LastPoppedStackElem()
-		testExpectedObject(t, tt.expected, stackElem)
+	byteCode := comp.Bytecode()
+	if err := Verify(byteCode); err != nil {
+		t.Fatalf("compiled bytecode fails verification: %s", err)
+	}
+
+	vm := New(byteCode, DefaultConfig())
+	fmt.Printf("Bytecode -> %v\n", byteCode.Instructions)
+	for i := range byteCode.Constants {
+		fmt.Printf("Bytecode const[%d] -> %v\n", i, byteCode.Constants[i])
+	}
 
+	err = vm.Run()
+	fmt.Println(vm.StackTrace())
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
 	}
+
+	stackElem := vm.LastPoppedStackElem()
+	testExpectedObject(t, expected, stackElem)
 }
 
 func testExpectedObject(t *testing.T, expected interface{}, actual object.Object) {
@@ -96,6 +136,10 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if err := testIntegerObject(int64(expected), actual); err != nil {
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
+	case float64:
+		if err := testFloatObject(expected, actual); err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
 	case bool:
 		if err := testBooleanObject(bool(expected), actual); err != nil {
 			t.Errorf("testBooleanObject failed: %s", err)
@@ -108,6 +152,15 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if actual != Null {
 			t.Errorf("object is not Null: %T (%+v)", actual, actual)
 		}
+	case *object.Error:
+		errObj, ok := actual.(*object.Error)
+		if !ok {
+			t.Errorf("object is not Error: %T (%+v)", actual, actual)
+			return
+		}
+		if errObj.Message != expected.Message {
+			t.Errorf("wrong error message. expected=%q, got=%q", expected.Message, errObj.Message)
+		}
 	case []interface{}:
 		array, ok := actual.(*object.Array)
 		if !ok {
@@ -235,6 +288,11 @@ func TestConditionals(t *testing.T) {
 		{"if (false) {10}", Null},
 		{"if (1 > 2) { 10 }", Null},
 		{"if (1 > 2) { 10 } else { 20 }", 20},
+		{"if (true) { }", Null},
+		{"if (true) { let b = 1; }", Null},
+		{"if (false) { 1 } else { let b = 2; }", Null},
+		{"let a = 5; if (true) { let b = 1; }; a", 5},
+		{"let f = fn() { if (true) { let b = 1; } }; f()", Null},
 	}
 
 	runVmTests(t, tests)
@@ -254,6 +312,23 @@ func TestStringExpr(t *testing.T) {
 		{`"monkey"`, "monkey"},
 		{`"mon" + "key"`, "monkey"},
 		{`"mon" + "key" + "banana"`, "monkeybanana"},
+		{`"monkey" == "monkey"`, true},
+		{`"monkey" != "monkey"`, false},
+		{`"monkey" != "banana"`, true},
+		{`let s = "mon"; s + "key" == "monkey"`, true},
+	}
+	runVmTests(t, tests)
+}
+
+// a concatenation at runtime is a new object, equal to a literal only by value
+func TestBuiltStringComparison(t *testing.T) {
+	tests := []vmTestCase{
+		{`let s = "mon"; "monkey" == s + "key"`, true},
+		{`let s = "mon"; s + "key" != "monkey"`, false},
+		{`let s = "mon"; s + "key" == "monkeys"`, false},
+		{`let s = "mon"; s + "key" != "donkey"`, true},
+		{`let s = "mon"; let t = "key"; s + t == t + s`, false},
+		{`let s = "mon"; let t = "key"; s + t == "mon" + t`, true},
 	}
 	runVmTests(t, tests)
 }
@@ -510,13 +585,17 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
 		}
-		vm := New(comp.Bytecode())
+		vm := New(comp.Bytecode(), DefaultConfig())
 		err = vm.Run()
 		if err == nil {
 			t.Fatalf("expected VM error but resulted in none.")
 		}
-		if err.Error() != tt.expected {
-			t.Fatalf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		rtErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("error is not *RuntimeError. got=%T (%s)", err, err)
+		}
+		if rtErr.Kind != InvalidCall || rtErr.Message != tt.expected {
+			t.Fatalf("wrong VM error: want=%q, got=%q (%s)", tt.expected, rtErr.Message, rtErr.Kind)
 		}
 	}
 }
@@ -625,3 +704,1127 @@ func TestRecursiveFunctions(t *testing.T) {
 	}
 	runVmTests(t, tests)
 }
+
+func TestBuiltinFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("")`, 0},
+		{`len("four")`, 4},
+		{`len("hello world")`, 11},
+		{
+			`len(1)`,
+			&object.Error{Message: "argument to `len` not supported, got INTEGER"},
+		},
+		{
+			`len("one", "two")`,
+			&object.Error{Message: "wrong number of arguments. got=2, want=1"},
+		},
+		{`len([1, 2, 3])`, 3},
+		{`len([])`, 0},
+		{`puts("hello", "world!")`, Null},
+		{`first([1, 2, 3])`, 1},
+		{`first([])`, Null},
+		{
+			`first(1)`,
+			&object.Error{Message: "argument to `first` must be ARRAY, got INTEGER"},
+		},
+		{`last([1, 2, 3])`, 3},
+		{`last([])`, Null},
+		{
+			`last(1)`,
+			&object.Error{Message: "argument to `last` must be ARRAY, got INTEGER"},
+		},
+		{`rest([1, 2, 3])`, []interface{}{2, 3}},
+		{`rest([])`, Null},
+		{`push([], 1)`, []interface{}{1}},
+		{
+			`push(1, 1)`,
+			&object.Error{Message: "argument to `push` must be ARRAY, got INTEGER"},
+		},
+		{`let arr = [1, 2]; let f = fn() { push(arr, len(arr) + 1) }; f()`, []interface{}{1, 2, 3}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestPutsWritesToConfigStdout(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse(`puts("hello", 1); let f = fn() { puts([2]) }; f();`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out strings.Builder
+	if err := New(comp.Bytecode(), Config{Stdout: &out}).Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if out.String() != "hello\n1\n[2]\n" {
+		t.Errorf("wrong output. got=%q", out.String())
+	}
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{
+			program:  asttest.Program(append([]ast.Statement{asttest.While("false", asttest.Stmts("1;")...)}, asttest.Stmts("5;")...)...),
+			expected: 5,
+		},
+		{
+			program:  asttest.Program(asttest.While("true", asttest.Break())),
+			expected: Null,
+		},
+		{
+			program: asttest.Program(
+				asttest.While("true",
+					asttest.If("true", asttest.Break()),
+					asttest.Continue(),
+				),
+			),
+			expected: Null,
+		},
+		{
+			program: asttest.Program(
+				asttest.While("true",
+					asttest.While("true", asttest.Break()),
+					asttest.Break(),
+				),
+				asttest.ExprStmt(asttest.Expr("10")),
+			),
+			expected: 10,
+		},
+		{
+			// 1 + if (true) { while (true) { break; }; 2 } -> the loop sits inside the expression
+			program: asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Expr("1"), "+", &ast.IfExpression{
+				Condition:   asttest.Expr("true"),
+				Consequence: asttest.Block(asttest.While("true", asttest.Break()), asttest.ExprStmt(asttest.Expr("2"))),
+			}))),
+			expected: 3,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestWhileLoopsInsideClosures(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{
+			// let f = fn(n) { while (n > 0) { if (n > 1) { break; }; continue; }; n }; f(2);
+			program: asttest.Program(
+				asttest.Let("f", asttest.Fn("n",
+					asttest.While("n > 0",
+						asttest.If("n > 1", asttest.Break()),
+						asttest.Continue(),
+					),
+					asttest.ExprStmt(asttest.Expr("n")),
+				)),
+				asttest.ExprStmt(asttest.Expr("f(2)")),
+			),
+			expected: 2,
+		},
+		{
+			// let outer = fn(a) { fn() { while (a) { break; }; a } }; outer(3)();
+			program: asttest.Program(
+				asttest.Let("outer", asttest.Fn("a",
+					asttest.ExprStmt(asttest.Fn("",
+						asttest.While("a", asttest.Break()),
+						asttest.ExprStmt(asttest.Expr("a")),
+					)),
+				)),
+				asttest.ExprStmt(asttest.Expr("outer(3)()")),
+			),
+			expected: 3,
+		},
+		{
+			// a loop closing out a function body makes it return null
+			program: asttest.Program(
+				asttest.Let("f", asttest.Fn("", asttest.While("true", asttest.Break()))),
+				asttest.ExprStmt(asttest.Expr("f()")),
+			),
+			expected: Null,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{
+			program:  asttest.Program(append(asttest.Stmts("let x = 1;"), asttest.Assign("x", "=", "2"))...),
+			expected: 2,
+		},
+		{
+			program:  asttest.Program(append(asttest.Stmts("let x = 10;"), asttest.Assign("x", "+=", "5"), asttest.Assign("x", "-=", "3"), asttest.Assign("x", "*=", "2"), asttest.Assign("x", "/=", "4"))...),
+			expected: 6,
+		},
+		{
+			// let f = fn() { let a = 1; a += 2; a }; f();
+			program: asttest.Program(
+				asttest.Let("f", asttest.Fn("", append(append(asttest.Stmts("let a = 1;"), asttest.Assign("a", "+=", "2")), asttest.Stmts("a")...)...)),
+				asttest.ExprStmt(asttest.Expr("f()")),
+			),
+			expected: 3,
+		},
+		{
+			program:  asttest.Program(append(asttest.Stmts("let arr = [1, 2, 3];"), asttest.Assign("arr[1]", "=", "5"), asttest.ExprStmt(asttest.Expr("arr")))...),
+			expected: []interface{}{1, 5, 3},
+		},
+		{
+			program:  asttest.Program(append(asttest.Stmts("let arr = [1, 2, 3];"), asttest.Assign("arr[2]", "*=", "10"))...),
+			expected: 30,
+		},
+		{
+			// let calls = 0; let next = fn() { calls += 1; calls }; let arr = [10, 20]; arr[next()] += 5; [arr[0], arr[1], calls];
+			program: asttest.Program(
+				asttest.Let("calls", asttest.Expr("0")),
+				asttest.Let("next", asttest.Fn("", asttest.Assign("calls", "+=", "1"), asttest.ExprStmt(asttest.Expr("calls")))),
+				asttest.Let("arr", asttest.Expr("[10, 20]")),
+				asttest.Assign("arr[next()]", "+=", "5"),
+				asttest.ExprStmt(asttest.Expr("[arr[0], arr[1], calls]")),
+			),
+			expected: []interface{}{10, 25, 1},
+		},
+		{
+			program:  asttest.Program(append(asttest.Stmts(`let h = {"a": 1};`), asttest.Assign(`h["b"]`, "=", "2"), asttest.ExprStmt(asttest.Expr(`h["a"] + h["b"]`)))...),
+			expected: 3,
+		},
+		{
+			// let i = 0; let sum = 0; while (i < 5) { sum += i; i += 1; }; sum;
+			program: asttest.Program(append(asttest.Stmts("let i = 0; let sum = 0;"),
+				asttest.While("i < 5",
+					asttest.Assign("sum", "+=", "i"),
+					asttest.Assign("i", "+=", "1"),
+				),
+				asttest.ExprStmt(asttest.Expr("sum")),
+			)...),
+			expected: 10,
+		},
+		{
+			// let f = fn(n) { let acc = []; let i = 0; while (true) { i += 1; if (i > n) { break; }; if (i == 2) { continue; }; acc = push(acc, i); }; acc }; f(4);
+			program: asttest.Program(
+				asttest.Let("f", asttest.Fn("n", append(asttest.Stmts("let acc = []; let i = 0;"),
+					asttest.While("true",
+						asttest.Assign("i", "+=", "1"),
+						asttest.If("i > n", asttest.Break()),
+						asttest.If("i == 2", asttest.Continue()),
+						asttest.Assign("acc", "=", "push(acc, i)"),
+					),
+					asttest.ExprStmt(asttest.Expr("acc")),
+				)...)),
+				asttest.ExprStmt(asttest.Expr("f(4)")),
+			),
+			expected: []interface{}{1, 3, 4},
+		},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestInvalidIndexAssignments(t *testing.T) {
+	tests := []struct {
+		program  *ast.Program
+		expected string
+	}{
+		{asttest.Program(append(asttest.Stmts("let arr = [1];"), asttest.Assign("arr[1]", "=", "2"))...), "array index out of range: 1"},
+		{asttest.Program(append(asttest.Stmts("let arr = [1];"), asttest.Assign(`arr["a"]`, "=", "2"))...), "array index must be INTEGER, got STRING"},
+		{asttest.Program(append(asttest.Stmts("let h = {};"), asttest.Assign("h[fn() {}]", "=", "2"))...), "unusable as hash key: CLOSURE"},
+		{asttest.Program(append(asttest.Stmts("let x = 1;"), asttest.Assign("x[0]", "=", "2"))...), "index assignment not supported: INTEGER"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(tt.program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(comp.Bytecode(), DefaultConfig())
+		err := vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+		rtErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("error is not *RuntimeError. got=%T (%s)", err, err)
+		}
+		if rtErr.Kind != InvalidIndex || rtErr.Message != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q (%s)", tt.expected, rtErr.Message, rtErr.Kind)
+		}
+	}
+}
+
+func TestMutableClosures(t *testing.T) {
+	// let newCounter = fn() { let count = 0; fn() { count += 1; count } };
+	newCounter := asttest.Let("newCounter", asttest.Fn("", append(asttest.Stmts("let count = 0;"),
+		asttest.ExprStmt(asttest.Fn("", asttest.Assign("count", "+=", "1"), asttest.ExprStmt(asttest.Expr("count")))),
+	)...))
+
+	tests := []vmProgramTestCase{
+		{
+			program:  asttest.Program(append([]ast.Statement{newCounter}, asttest.Stmts("let c = newCounter(); c(); c(); c();")...)...),
+			expected: 3,
+		},
+		{
+			// every call gets its own cell
+			program:  asttest.Program(append([]ast.Statement{newCounter}, asttest.Stmts("let one = newCounter(); let two = newCounter(); one(); one(); two();")...)...),
+			expected: 1,
+		},
+		{
+			// let make = fn() { let n = 0; [fn() { n += 1 }, fn() { n }] }; let p = make(); p[0](); p[0](); p[1]();
+			program: asttest.Program(append([]ast.Statement{
+				asttest.Let("make", asttest.Fn("", append(asttest.Stmts("let n = 0;"),
+					asttest.ExprStmt(&ast.ArrayLiteral{Elements: []ast.Expression{
+						asttest.Fn("", asttest.Assign("n", "+=", "1")),
+						asttest.Fn("", asttest.ExprStmt(asttest.Expr("n"))),
+					}}),
+				)...)),
+			}, asttest.Stmts("let p = make(); p[0](); p[0](); p[1]();")...)...),
+			expected: 2,
+		},
+		{
+			// let f = fn() { let x = 1; let g = fn() { x = 5 }; g(); x }; f();
+			program: asttest.Program(
+				asttest.Let("f", asttest.Fn("", append(append(asttest.Stmts("let x = 1;"),
+					asttest.Let("g", asttest.Fn("", asttest.Assign("x", "=", "5")))),
+					asttest.Stmts("g(); x;")...,
+				)...)),
+				asttest.ExprStmt(asttest.Expr("f()")),
+			),
+			expected: 5,
+		},
+		{
+			// let f = fn() { let x = 1; let g = fn() { x }; x = 7; g() }; f();
+			program: asttest.Program(
+				asttest.Let("f", asttest.Fn("", append(asttest.Stmts("let x = 1; let g = fn() { x };"),
+					asttest.Assign("x", "=", "7"),
+					asttest.ExprStmt(asttest.Expr("g()")),
+				)...)),
+				asttest.ExprStmt(asttest.Expr("f()")),
+			),
+			expected: 7,
+		},
+		{
+			// let f = fn() { let x = 0; let g = fn() { fn() { x += 10 } }; g()(); x }; f();
+			program: asttest.Program(
+				asttest.Let("f", asttest.Fn("", append(append(asttest.Stmts("let x = 0;"),
+					asttest.Let("g", asttest.Fn("", asttest.ExprStmt(asttest.Fn("", asttest.Assign("x", "+=", "10")))))),
+					asttest.Stmts("g()(); x;")...,
+				)...)),
+				asttest.ExprStmt(asttest.Expr("f()")),
+			),
+			expected: 10,
+		},
+		{
+			// let acc = fn(total) { fn(n) { total += n; total } }; let a = acc(10); a(5); a(5);
+			program: asttest.Program(append([]ast.Statement{
+				asttest.Let("acc", asttest.Fn("total",
+					asttest.ExprStmt(asttest.Fn("n", asttest.Assign("total", "+=", "n"), asttest.ExprStmt(asttest.Expr("total")))),
+				)),
+			}, asttest.Stmts("let a = acc(10); a(5); a(5);")...)...),
+			expected: 20,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{asttest.Program(asttest.ExprStmt(asttest.Logical("true", "&&", "true"))), true},
+		{asttest.Program(asttest.ExprStmt(asttest.Logical("true", "&&", "false"))), false},
+		{asttest.Program(asttest.ExprStmt(asttest.Logical("false", "&&", "true"))), false},
+		{asttest.Program(asttest.ExprStmt(asttest.Logical("false", "||", "false"))), false},
+		{asttest.Program(asttest.ExprStmt(asttest.Logical("false", "||", "true"))), true},
+		{asttest.Program(asttest.ExprStmt(asttest.Logical("true", "||", "false"))), true},
+		{asttest.Program(asttest.ExprStmt(asttest.Logical(`1`, "&&", `"a"`))), true},
+		{asttest.Program(asttest.ExprStmt(asttest.Logical(`if (false) { 1 }`, "||", `0`))), true},
+		{asttest.Program(asttest.ExprStmt(asttest.Logical(`if (false) { 1 }`, "&&", `1`))), false},
+		// the right side would fail at runtime, so it must never be evaluated
+		{asttest.Program(asttest.ExprStmt(asttest.Logical("false", "&&", "1 + true"))), false},
+		{asttest.Program(asttest.ExprStmt(asttest.Logical("true", "||", "1 + true"))), true},
+		{
+			asttest.Program(asttest.ExprStmt(&ast.InfixExpression{
+				Left:     asttest.Logical("1 > 2", "||", "2 > 1"),
+				Operator: "&&",
+				Right:    asttest.Logical("false", "||", `"x" == "x"`),
+			})),
+			true,
+		},
+		{
+			// let i = 0; while (i < 10 && i != 3) { i += 1 }; i;
+			asttest.Program(append(asttest.Stmts("let i = 0;"),
+				&code.WhileStatement{Condition: asttest.Logical("i < 10", "&&", "i != 3"), Body: asttest.Block(asttest.Assign("i", "+=", "1"))},
+				asttest.ExprStmt(asttest.Expr("i")),
+			)...),
+			3,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{asttest.Program(asttest.ExprStmt(asttest.Float("0.5"))), 0.5},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Float("0.5"), "+", asttest.Float("0.25")))), 0.75},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Float("0.5"), "+", asttest.Expr("1")))), 1.5},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Expr("3"), "-", asttest.Float("0.5")))), 2.5},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Expr("4"), "*", asttest.Float("2.5")))), 10.0},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Expr("1"), "/", asttest.Float("4.0")))), 0.25},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Float("7.5"), "/", asttest.Expr("2")))), 3.75},
+		{asttest.Program(asttest.ExprStmt(&ast.PrefixExpression{Operator: "-", Right: asttest.Float("1.5")})), -1.5},
+		// integer only arithmetic is not promoted
+		{asttest.Program(asttest.ExprStmt(asttest.Expr("7 / 2"))), 3},
+		{
+			// let price = 20.5; let qty = 3; price * qty - 0.5;
+			asttest.Program(
+				asttest.Let("price", asttest.Float("20.5")),
+				asttest.Let("qty", asttest.Expr("3")),
+				asttest.ExprStmt(asttest.Infix(asttest.Infix(asttest.Expr("price"), "*", asttest.Expr("qty")), "-", asttest.Float("0.5"))),
+			),
+			61.0,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestFloatComparisons(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Float("0.5"), "<", asttest.Float("0.75")))), true},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Float("0.5"), ">", asttest.Expr("1")))), false},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Expr("1"), ">=", asttest.Float("1.0")))), true},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Expr("2"), "<=", asttest.Float("1.5")))), false},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Float("1.0"), "==", asttest.Expr("1")))), true},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Float("1.5"), "!=", asttest.Expr("1")))), true},
+		{asttest.Program(asttest.ExprStmt(asttest.Infix(asttest.Float("1.5"), "==", asttest.Float("1.5")))), true},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		kind     ErrorKind
+		message  string
+		opcode   code.Opcode
+		offset   int
+		function string
+	}{
+		{"1 / 0", DivisionByZero, "division by zero: 1 / 0", code.OpDiv, 6, "<main>"},
+		{`1 + "a"`, TypeMismatch, "unsupported types for binary operation: INTEGER STRING", code.OpAdd, 6, "<main>"},
+		{`-"a"`, TypeMismatch, "unsupported type for negation: STRING", code.OpMinus, 3, "<main>"},
+		{`"a" > "b"`, TypeMismatch, fmt.Sprintf("unknown operator: %d (STRING STRING)", code.OpGreaterThan), code.OpGreaterThan, 6, "<main>"},
+		{"[1][true]", InvalidIndex, "array index must be INTEGER, got BOOLEAN", code.OpIndex, 7, "<main>"},
+		{"1[0]", InvalidIndex, "index operator not supported: INTEGER", code.OpIndex, 6, "<main>"},
+		{"1()", InvalidCall, "calling non-function", code.OpCall, 3, "<main>"},
+		{"return 1;", InvalidCall, "return outside of function", code.OpReturnValue, 3, "<main>"},
+		{"let divide = fn(a, b) { a / b }; divide(1, 0);", DivisionByZero, "division by zero: 1 / 0", code.OpDiv, 4, "divide"},
+		{"fn() { true > false }();", TypeMismatch, fmt.Sprintf("unknown operator: %d (BOOLEAN BOOLEAN)", code.OpGreaterThan), code.OpGreaterThan, 2, "<anonymous>"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err := New(comp.Bytecode(), DefaultConfig()).Run()
+		rtErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("%s: error is not *RuntimeError. got=%T (%v)", tt.input, err, err)
+		}
+
+		if rtErr.Kind != tt.kind {
+			t.Errorf("%s: wrong kind. want=%q, got=%q", tt.input, tt.kind, rtErr.Kind)
+		}
+		if rtErr.Message != tt.message {
+			t.Errorf("%s: wrong message. want=%q, got=%q", tt.input, tt.message, rtErr.Message)
+		}
+		if rtErr.Opcode != tt.opcode {
+			t.Errorf("%s: wrong opcode. want=%d, got=%d", tt.input, tt.opcode, rtErr.Opcode)
+		}
+		if rtErr.Offset != tt.offset {
+			t.Errorf("%s: wrong offset. want=%d, got=%d", tt.input, tt.offset, rtErr.Offset)
+		}
+		if rtErr.Function != tt.function {
+			t.Errorf("%s: wrong function. want=%q, got=%q", tt.input, tt.function, rtErr.Function)
+		}
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	tests := []struct {
+		program *ast.Program
+		config  Config
+		kind    ErrorKind
+		message string
+	}{
+		{
+			parse("let f = fn(n) { f(n + 1) }; f(0);"),
+			Config{MaxFrames: 50},
+			StackOverflow,
+			"stack overflow: more than 50 nested calls",
+		},
+		{
+			parse("let f = fn() { f() }; f();"),
+			DefaultConfig(),
+			StackOverflow,
+			fmt.Sprintf("stack overflow: more than %d nested calls", ActivationRecordSize),
+		},
+		{
+			parse("[1, 2, 3, 4, 5, 6, 7, 8, 9];"),
+			Config{StackSize: 8},
+			StackOverflow,
+			"stack overflow",
+		},
+		{
+			parse("let a = 1; let b = 2; let c = 3;"),
+			Config{GlobalsSize: 2},
+			GlobalsExhausted,
+			"global 2 out of range, limit is 2",
+		},
+		{
+			asttest.Program(asttest.While("true", asttest.Stmts("1;")...)),
+			Config{MaxInstructions: 100},
+			InstructionLimit,
+			"instruction limit of 100 exceeded",
+		},
+		{
+			parse(`let a = "a"; [[1], [2], a + "b"];`),
+			Config{MaxHeapObjects: 3},
+			HeapLimit,
+			"heap limit of 3 objects exceeded",
+		},
+	}
+
+	for i, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(tt.program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err := New(comp.Bytecode(), tt.config).Run()
+		rtErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("test %d: error is not *RuntimeError. got=%T (%v)", i, err, err)
+		}
+		if rtErr.Kind != tt.kind {
+			t.Errorf("test %d: wrong kind. want=%q, got=%q", i, tt.kind, rtErr.Kind)
+		}
+		if rtErr.Message != tt.message {
+			t.Errorf("test %d: wrong message. want=%q, got=%q", i, tt.message, rtErr.Message)
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	loop := asttest.Program(append(asttest.Stmts("let f = fn(x) { x };"), asttest.While("true", asttest.Stmts("f(1);")...))...)
+	spin := asttest.Program(append(asttest.Stmts("let n = 0;"), asttest.While("true", asttest.Assign("n", "+=", "1")))...)
+
+	tests := []struct {
+		program *ast.Program
+		ctx     func() (context.Context, context.CancelFunc)
+		err     error
+	}{
+		{loop, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 20*time.Millisecond)
+		}, context.DeadlineExceeded},
+		{spin, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 20*time.Millisecond)
+		}, context.DeadlineExceeded},
+		{spin, func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}, context.Canceled},
+	}
+
+	for i, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(tt.program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		ctx, cancel := tt.ctx()
+		vm := New(comp.Bytecode(), DefaultConfig())
+		err := vm.RunContext(ctx)
+		cancel()
+		if err != tt.err {
+			t.Fatalf("test %d: wrong error. want=%v, got=%v", i, tt.err, err)
+		}
+
+		// stopped between two instructions of main, everything left to look at
+		if len(vm.Traceback()) == 0 {
+			t.Errorf("test %d: no frames left after cancellation", i)
+		}
+	}
+}
+
+func TestStep(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let one = 1; one + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode(), DefaultConfig())
+
+	expected := []struct {
+		ip    int
+		stack []interface{}
+	}{
+		{3, []interface{}{1}},
+		{6, []interface{}{}},
+		{9, []interface{}{1}},
+		{12, []interface{}{1, 2}},
+		{13, []interface{}{3}},
+		{14, []interface{}{}},
+	}
+	if ip := vm.CurrentRecord().IP(); ip != 0 {
+		t.Fatalf("wrong ip before the first step. want=0, got=%d", ip)
+	}
+	for i, tt := range expected {
+		if err := vm.Step(); err != nil {
+			t.Fatalf("step %d: %s", i, err)
+		}
+		if ip := vm.CurrentRecord().IP(); ip != tt.ip {
+			t.Errorf("step %d: wrong ip. want=%d, got=%d", i, tt.ip, ip)
+		}
+		stack := vm.Stack()
+		if len(stack) != len(tt.stack) {
+			t.Fatalf("step %d: wrong stack. want=%v, got=%v", i, tt.stack, stack)
+		}
+		for j, want := range tt.stack {
+			testExpectedObject(t, want, stack[j])
+		}
+	}
+
+	if !vm.Halted() {
+		t.Errorf("vm not halted after the last instruction")
+	}
+	if err := vm.Step(); err != ErrHalted {
+		t.Errorf("wrong error stepping a finished vm. want=%v, got=%v", ErrHalted, err)
+	}
+}
+
+func TestRunUntilAndResume(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let add = fn(a, b) { a + b }; add(1, 2) + add(3, 4);")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode(), DefaultConfig())
+
+	inAdd := func(vm *VM) bool { return vm.CurrentRecord().Function().Name == "add" && vm.CurrentRecord().IP() == 0 }
+	for i, args := range [][]int{{1, 2}, {3, 4}} {
+		stopped, err := vm.RunUntil(inAdd)
+		if err != nil {
+			t.Fatalf("call %d: vm error: %s", i, err)
+		}
+		if !stopped {
+			t.Fatalf("call %d: program ended before reaching add", i)
+		}
+
+		record := vm.CurrentRecord()
+		stack := vm.Stack()
+		testExpectedObject(t, args[0], stack[record.BasePointer()])
+		testExpectedObject(t, args[1], stack[record.BasePointer()+1])
+	}
+
+	stopped, err := vm.RunUntil(inAdd)
+	if err != nil || stopped {
+		t.Fatalf("expected the program to end. stopped=%t, err=%v", stopped, err)
+	}
+	testExpectedObject(t, 10, vm.LastPoppedStackElem())
+}
+
+type recordingTracer struct {
+	events []string
+}
+
+func (r *recordingTracer) Dispatch(fn *code.CompiledFunction, ip int, op code.Opcode, operands []int, stackDepth int) {
+	def, _ := code.Lookup(byte(op))
+	r.events = append(r.events, fmt.Sprintf("%s %04d %s %v %d", fn.DisplayName(), ip, def.Name, operands, stackDepth))
+}
+
+func (r *recordingTracer) Enter(fn *code.CompiledFunction, args []object.Object) {
+	r.events = append(r.events, fmt.Sprintf("enter %s %d", fn.DisplayName(), len(args)))
+}
+
+func (r *recordingTracer) Exit(fn *code.CompiledFunction, result object.Object) {
+	r.events = append(r.events, fmt.Sprintf("exit %s %s", fn.DisplayName(), result.Inspect()))
+}
+
+func (r *recordingTracer) SetGlobal(index int, value object.Object) {
+	r.events = append(r.events, fmt.Sprintf("global %d %s", index, value.Inspect()))
+}
+
+func TestTracer(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let f = fn(x) { x }; let y = f(7); fn() { }();")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	tracer := &recordingTracer{}
+	vm := New(comp.Bytecode(), DefaultConfig())
+	vm.SetTracer(tracer)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	expected := []string{
+		"<main> 0000 OpClosure [0 0] 0",
+		"<main> 0004 OpSetGlobal [0] 1",
+		"global 0 Closure",
+		"<main> 0007 OpGetGlobal [0] 0",
+		"<main> 0010 OpConstant [1] 1",
+		"<main> 0013 OpCall [1] 2",
+		"enter f 1",
+		"f 0000 OpGetLocal [0] 2",
+		"f 0002 OpReturnValue [] 3",
+		"exit f 7",
+		"<main> 0015 OpSetGlobal [1] 1",
+		"global 1 7",
+		"<main> 0018 OpClosure [2 0] 0",
+		"<main> 0022 OpCall [0] 1",
+		"enter <anonymous> 0",
+		"<anonymous> 0000 OpReturn [] 1",
+		"exit <anonymous> null",
+		"<main> 0024 OpPop [] 1",
+	}
+	if len(tracer.events) != len(expected) {
+		t.Fatalf("wrong number of events. want=%d, got=%d\n%s", len(expected), len(tracer.events), strings.Join(tracer.events, "\n"))
+	}
+	for i, want := range expected {
+		if !strings.HasPrefix(tracer.events[i], want) {
+			t.Errorf("event %d: want=%q, got=%q", i, want, tracer.events[i])
+		}
+	}
+}
+
+func TestLogTracer(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let add = fn(a, b) { a + b }; add(1, 2);")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out strings.Builder
+	vm := New(comp.Bytecode(), DefaultConfig())
+	vm.SetTracer(NewLogTracer(&out))
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	for _, want := range []string{
+		"0016  OpCall 2                       sp=3\n-> add(1, 2)\n  0000  OpGetLocal 0                   sp=3\n",
+		"<- add = 3\n0018  OpPop                          sp=1\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	input := "let sq = fn(x) { x * x };\nlet twice = fn(x) { sq(x) + sq(x) };\ntwice(3);"
+	comp := compiler.New()
+	comp.SetSource("prof.mk", input)
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// every event is one millisecond after the previous one
+	clock := time.Unix(0, 0)
+	profiler := NewProfiler()
+	profiler.now = func() time.Time {
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+
+	vm := New(comp.Bytecode(), DefaultConfig())
+	vm.SetTracer(profiler)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	profiler.Stop()
+
+	expected := map[string]FunctionProfile{
+		// 8 ticks of its own, 22 from calling twice
+		"<main>": {Calls: 1, Instructions: 8, Inclusive: 30 * time.Millisecond, Exclusive: 9 * time.Millisecond},
+		"twice":  {Calls: 1, Instructions: 8, Inclusive: 21 * time.Millisecond, Exclusive: 11 * time.Millisecond},
+		"sq":     {Calls: 2, Instructions: 8, Inclusive: 10 * time.Millisecond, Exclusive: 10 * time.Millisecond},
+	}
+	functions := profiler.Functions()
+	if len(functions) != len(expected) {
+		t.Fatalf("wrong number of functions. got=%+v", functions)
+	}
+	for _, f := range functions {
+		want := expected[f.Name]
+		if f.Calls != want.Calls || f.Instructions != want.Instructions || f.Inclusive != want.Inclusive || f.Exclusive != want.Exclusive {
+			t.Errorf("wrong profile of %s.\nwant=%+v\ngot =%+v", f.Name, want, f)
+		}
+	}
+
+	opcodes := map[code.Opcode]int64{}
+	for _, c := range profiler.Opcodes() {
+		opcodes[c.Op] = c.Count
+	}
+	for op, want := range map[code.Opcode]int64{code.OpCall: 3, code.OpGetLocal: 6, code.OpMul: 2, code.OpReturnValue: 3} {
+		if opcodes[op] != want {
+			t.Errorf("wrong count of opcode %d. want=%d, got=%d", op, want, opcodes[op])
+		}
+	}
+
+	var out bytes.Buffer
+	if err := profiler.WritePprof(&out); err != nil {
+		t.Fatalf("pprof error: %s", err)
+	}
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatalf("profile is not gzipped: %s", err)
+	}
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("profile is not gzipped: %s", err)
+	}
+	for _, name := range []string{"executed_instructions", "wall_time", "nanoseconds", "main", "twice", "sq", "prof.mk"} {
+		if !bytes.Contains(raw, []byte(name)) {
+			t.Errorf("profile is missing string %q", name)
+		}
+	}
+}
+
+func TestProfilerAttachedMidRun(t *testing.T) {
+	input := "let sq = fn(x) { x * x };\nlet twice = fn(x) { sq(x) + sq(x) };\ntwice(3);"
+	comp := compiler.New()
+	comp.SetSource("prof.mk", input)
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// inside the first sq, main and twice were entered without the profiler
+	vm := New(comp.Bytecode(), DefaultConfig())
+	if stopped, err := vm.RunUntil(func(vm *VM) bool { return vm.Depth() == 3 }); !stopped || err != nil {
+		t.Fatalf("did not stop in sq: %v", err)
+	}
+
+	profiler := NewProfiler()
+	vm.SetTracer(profiler)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	profiler.Stop()
+
+	names := map[string]bool{}
+	for _, f := range profiler.Functions() {
+		names[f.Name] = true
+	}
+	for _, name := range []string{"sq", "twice", "<main>"} {
+		if !names[name] {
+			t.Errorf("missing profile of %s", name)
+		}
+	}
+	if err := profiler.WritePprof(io.Discard); err != nil {
+		t.Errorf("pprof error: %s", err)
+	}
+
+	// events without a frame to belong to
+	lone := NewProfiler()
+	lone.Exit(&code.CompiledFunction{Name: "f"}, Null)
+	lone.Enter(&code.CompiledFunction{Name: "g"}, nil)
+	lone.Exit(&code.CompiledFunction{Name: "g"}, Null)
+	lone.Exit(&code.CompiledFunction{Name: "f"}, Null)
+	lone.Stop()
+}
+
+func TestCoverage(t *testing.T) {
+	input := "let classify = fn(n) {\n  if (n > 10) {\n    \"big\"\n  } else {\n    \"small\"\n  }\n};\nlet unused = fn() { 1 };\nclassify(3);"
+	comp := compiler.New()
+	comp.SetSource("cover.mk", input)
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+	coverage := NewCoverage(bytecode)
+	vm := New(bytecode, DefaultConfig())
+	vm.SetTracer(coverage)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	var out strings.Builder
+	if err := coverage.WriteLCOV(&out); err != nil {
+		t.Fatalf("lcov error: %s", err)
+	}
+	for _, want := range []string{
+		"SF:cover.mk\n",
+		"FNDA:1,classify\n",
+		"FNDA:0,unused\n",
+		"FNF:2\nFNH:1\n",
+		// the condition is false, so the jump to the else branch is taken
+		"BRDA:2,0,0,0\nBRDA:2,0,1,1\n",
+		"DA:3,0\n",
+		"DA:5,1\n",
+		"end_of_record\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in\n%s", want, out.String())
+		}
+	}
+
+	var html strings.Builder
+	if err := coverage.WriteHTML(&html, map[string]string{"cover.mk": input}); err != nil {
+		t.Fatalf("html error: %s", err)
+	}
+	for _, want := range []string{`class="miss"`, `class="partial"`, "&#34;big&#34;"} {
+		if !strings.Contains(html.String(), want) {
+			t.Errorf("missing %q in html report", want)
+		}
+	}
+}
+
+func TestCoverageCallsOfLoopHeadedFunction(t *testing.T) {
+	input := "let spin = fn(n) { n };\nspin(3);"
+	program := parse(input)
+	// let spin = fn(n) { while (n > 0) { n -= 1; }; n };
+	spin := program.Statements[0].(*ast.LetStatement).Value.(*ast.FunctionBlock)
+	spin.Body = asttest.Block(asttest.While("n > 0", asttest.Assign("n", "-=", "1")), asttest.ExprStmt(asttest.Expr("n")))
+
+	comp := compiler.New()
+	comp.SetSource("spin.mk", input)
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+	coverage := NewCoverage(bytecode)
+	vm := New(bytecode, DefaultConfig())
+	vm.SetTracer(coverage)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	var out strings.Builder
+	if err := coverage.WriteLCOV(&out); err != nil {
+		t.Fatalf("lcov error: %s", err)
+	}
+	if !strings.Contains(out.String(), "FNDA:1,spin\n") {
+		t.Errorf("spin should be called once in\n%s", out.String())
+	}
+}
+
+func TestRuntimeErrorPositions(t *testing.T) {
+	input := "let divide = fn(a, b) {\n  a / b\n};\ndivide(1, 0);"
+
+	comp := compiler.New()
+	comp.SetSource("calc.mk", input)
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := New(comp.Bytecode(), DefaultConfig()).Run()
+	rtErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("error is not *RuntimeError. got=%T (%v)", err, err)
+	}
+
+	expectedPos := code.Position{File: "calc.mk", Line: 2, Column: 5}
+	if rtErr.Pos != expectedPos {
+		t.Errorf("wrong position. want=%s, got=%s", expectedPos, rtErr.Pos)
+	}
+	expected := "calc.mk:2:5: division by zero: 1 / 0 (OpDiv at 0004 in divide)"
+	if rtErr.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, rtErr)
+	}
+}
+
+func TestRuntimeErrorTraceback(t *testing.T) {
+	input := "let inner = fn(a) {\n  a / 0\n};\nlet outer = fn(x) {\n  inner(x) + 1\n};\nouter(5);"
+
+	comp := compiler.New()
+	comp.SetSource("calc.mk", input)
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := New(comp.Bytecode(), DefaultConfig()).Run()
+	rtErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("error is not *RuntimeError. got=%T (%v)", err, err)
+	}
+
+	expected := Traceback{
+		{Function: "<main>", Offset: 20, Pos: code.Position{File: "calc.mk", Line: 7, Column: 6}},
+		{Function: "outer", Offset: 5, Pos: code.Position{File: "calc.mk", Line: 5, Column: 8}},
+		{Function: "inner", Offset: 5, Pos: code.Position{File: "calc.mk", Line: 2, Column: 5}},
+	}
+	if len(rtErr.Traceback) != len(expected) {
+		t.Fatalf("wrong number of frames. want=%d, got=%d\n%s", len(expected), len(rtErr.Traceback), rtErr.Traceback)
+	}
+	for i, frame := range expected {
+		if rtErr.Traceback[i] != frame {
+			t.Errorf("wrong frame %d. want=%+v, got=%+v", i, frame, rtErr.Traceback[i])
+		}
+	}
+
+	expectedString := `traceback (most recent call last):
+  <main> at 0020 (calc.mk:7:6)
+  outer at 0005 (calc.mk:5:8)
+  inner at 0005 (calc.mk:2:5)
+`
+	if rtErr.Traceback.String() != expectedString {
+		t.Errorf("wrong traceback.\nwant=%q\ngot =%q", expectedString, rtErr.Traceback.String())
+	}
+}
+
+func TestAssembledPrograms(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected interface{}
+	}{
+		{
+			`
+.const int 10
+.const int 1
+    OpConstant 0
+    OpSetGlobal 0
+loop:
+    OpGetGlobal 0
+    OpConstant 1
+    OpGreaterThan
+    OpJumpNotTruthy done
+    OpGetGlobal 0
+    OpConstant 1
+    OpSub
+    OpSetGlobal 0
+    OpJump loop
+done:
+    OpGetGlobal 0
+    OpPop
+`,
+			1,
+		},
+		{
+			`
+    OpClosure 0 0
+    OpConstant 1
+    OpCall 1
+    OpPop
+.func "double" params=1 locals=1
+    OpGetLocal 0
+    OpGetLocal 0
+    OpAdd
+    OpReturnValue
+.const float 1.25
+`,
+			2.5,
+		},
+	}
+
+	for _, tt := range tests {
+		bytecode, err := asm.Assemble(tt.src)
+		if err != nil {
+			t.Fatalf("assemble error: %s", err)
+		}
+
+		vm := New(bytecode, DefaultConfig())
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestWideOperands(t *testing.T) {
+	names, body := "", ""
+	for i := 0; i < 300; i++ {
+		name := "v" + string(rune('a'+i/26%26)) + string(rune('a'+i%26)) // never a keyword
+		body += fmt.Sprintf("let %s = %d; ", name, i)
+		names = name
+	}
+	far := ""
+	for i := 0; i < 17000; i++ {
+		far += fmt.Sprintf("%d; ", i)
+	}
+
+	tests := []vmProgramTestCase{
+		{parse(fmt.Sprintf("fn() { %s%s }()", body, names)), 299},
+		{parse(fmt.Sprintf("if (true) { %s}", far)), 16999},
+		{parse(fmt.Sprintf("if (false) { %s} else { 7 }", far)), 7},
+		{
+			asttest.Program(append(asttest.Stmts("let n = 0;"),
+				asttest.While("n < 2", append(asttest.Stmts(fmt.Sprintf("if (n > 0) { %s};", far)), asttest.Assign("n", "=", "n + 1"))...),
+				asttest.ExprStmt(asttest.Expr("n")))...),
+			2,
+		},
+	}
+
+	// runVmTest would print every one of the instructions
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(tt.program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := comp.Bytecode()
+		if err := Verify(bytecode); err != nil {
+			t.Fatalf("compiled bytecode fails verification: %s", err)
+		}
+
+		vm := New(bytecode, DefaultConfig())
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestRuntimeErrorsNeverPanic(t *testing.T) {
+	tests := []struct {
+		name     string
+		bytecode *compiler.Bytecode
+		kind     ErrorKind
+	}{
+		{
+			"pop on empty stack",
+			&compiler.Bytecode{Instructions: code.MustMake(code.OpPop)},
+			StackUnderflow,
+		},
+		{
+			"constant index out of range",
+			&compiler.Bytecode{Instructions: code.MustMake(code.OpConstant, 5)},
+			InternalError,
+		},
+		{
+			"float division by zero",
+			&compiler.Bytecode{
+				Instructions: append(append(code.MustMake(code.OpConstant, 0), code.MustMake(code.OpConstant, 1)...), code.MustMake(code.OpDiv)...),
+				Constants:    []object.Object{&code.Float{Value: 1.5}, &object.Integer{Value: 0}},
+			},
+			DivisionByZero,
+		},
+	}
+
+	for _, tt := range tests {
+		err := New(tt.bytecode, DefaultConfig()).Run()
+		rtErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("%s: error is not *RuntimeError. got=%T (%v)", tt.name, err, err)
+		}
+		if rtErr.Kind != tt.kind {
+			t.Errorf("%s: wrong kind. want=%q, got=%q (%s)", tt.name, tt.kind, rtErr.Kind, rtErr)
+		}
+	}
+
+	// an instruction pointer past the end is reported, not indexed
+	machine := New(&compiler.Bytecode{Instructions: code.MustMake(code.OpNull)}, DefaultConfig())
+	machine.currentRecord().instructionPointer = 4
+	rtErr, ok := machine.step().(*RuntimeError)
+	if !ok || rtErr.Kind != InternalError || rtErr.Offset != 5 {
+		t.Errorf("stepping past the end: want an internal error at 0005, got=%v", rtErr)
+	}
+
+	// unbounded recursion must surface as an error instead of crashing the host
+	comp := compiler.New()
+	if err := comp.Compile(parse("let f = fn() { f() }; f();")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if err := New(comp.Bytecode(), DefaultConfig()).Run(); err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+}